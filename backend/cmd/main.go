@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	config "github.com/theEricHoang/lovenote/backend/internal"
 	"github.com/theEricHoang/lovenote/backend/internal/api"
@@ -15,18 +16,30 @@ import (
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/handlers"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/credentials"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/eventbus"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/imageservice"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/mailer"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/passhash"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/ratelimit"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
 
 	notedao "github.com/theEricHoang/lovenote/backend/internal/api/notes/dao"
 	notehandlers "github.com/theEricHoang/lovenote/backend/internal/api/notes/handlers"
+	realtimehandlers "github.com/theEricHoang/lovenote/backend/internal/api/realtime/handlers"
 
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func main() {
-	config.LoadConfig() // load env vars
+	cfg := config.LoadConfig() // load env vars
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
 
 	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
 	if err != nil {
@@ -42,19 +55,86 @@ func main() {
 	}
 	defer database.Close()
 
-	authService := auth.NewAuthService(database)
-	userDAO := dao.NewUserDAO(database)
-	relationshipDAO := dao.NewRelationshipDAO(database)
-	inviteDAO := dao.NewInviteDAO(database)
+	relationshipDAO := dao.NewRelationshipDAO(database, cfg)
+	userDAO := dao.NewUserDAO(database, relationshipDAO)
+	tokenDAO := dao.NewTokenDAO(database)
+	inviteDAO := dao.NewInviteDAO(database, relationshipDAO)
+	inviteLinkDAO := dao.NewInviteLinkDAO(database, relationshipDAO)
 	noteDAO := notedao.NewNoteDAO(database)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := eventbus.NewBus(database)
+
+	revocations := auth.NewRevocationList(database, bus)
+	if err := revocations.Reload(ctx); err != nil {
+		log.Printf("Failed to load revoked tokens: %v", err)
+	}
+	go revocations.Sync(ctx, time.Minute)
+	keys, err := auth.LoadKeySet(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	hasher, err := passhash.NewHasher(cfg.PasswordHashAlgorithm, cfg.BcryptCost, passhash.Argon2Params{
+		Memory:  uint32(cfg.Argon2Memory),
+		Time:    uint32(cfg.Argon2Time),
+		Threads: uint8(cfg.Argon2Threads),
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure password hashing: %v", err)
+	}
+	authService, err := auth.NewAuthService(database, revocations, keys, hasher)
+	if err != nil {
+		log.Fatalf("Failed to create auth service: %v", err)
+	}
+	passkeyService, err := auth.NewPasskeyService(database, authService, cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure passkeys: %v", err)
+	}
+	oauthService, err := auth.NewOAuthService(database, cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure oauth providers: %v", err)
+	}
+
+	// every instance relays bus events into its own hub, including the ones it published itself
+	hub := realtime.NewHub()
+	go hub.Relay(ctx, bus)
+
+	// the event log only has to cover clients reconnecting after a while offline
+	eventLog := realtime.NewEventLog(database)
+	go eventLog.Prune(ctx, 7*24*time.Hour, time.Hour)
+	go inviteDAO.ExpireInvites(ctx, time.Hour)
+	publisher := realtime.NewPublisher(bus, eventLog)
+
 	authMiddleware := middleware.NewAuthMiddleware(authService)
-	permissionsMiddleware := middleware.NewPermissionsMiddleware(relationshipDAO, noteDAO)
+	permissionsMiddleware := middleware.NewPermissionsMiddleware(relationshipDAO, noteDAO, userDAO)
+
+	var rateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimitStore == "postgres" {
+		postgresStore := ratelimit.NewPostgresStore(database)
+		go postgresStore.Prune(ctx, 24*time.Hour, time.Hour)
+		rateLimitStore = postgresStore
+	}
+	rateLimiter := middleware.NewRateLimiter(rateLimitStore)
+
+	validator, err := credentials.NewValidator(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
 
-	userHandler := handlers.NewUserHandler(userDAO, authService)
-	relationshipHandler := handlers.NewRelationshipHandler(relationshipDAO)
-	inviteHandler := handlers.NewInviteHandler(inviteDAO, relationshipDAO)
-	noteHandler := notehandlers.NewNoteHandler(noteDAO, relationshipDAO)
+	userHandler := handlers.NewUserHandler(userDAO, tokenDAO, authService, auth.NewLoginThrottle(database, cfg), validator, mailer.NewMailer(cfg), publisher, cfg.AppURL)
+	sessionHandler := handlers.NewSessionHandler(authService)
+	mfaHandler := handlers.NewMFAHandler(userDAO, authService)
+	passkeyHandler := handlers.NewPasskeyHandler(userDAO, passkeyService)
+	oauthHandler := handlers.NewOAuthHandler(oauthService, authService, cfg.AppURL)
+	keyHandler := handlers.NewKeyHandler(authService)
+	relationshipHandler := handlers.NewRelationshipHandler(relationshipDAO, publisher)
+	inviteHandler := handlers.NewInviteHandler(inviteDAO, relationshipDAO, publisher, cfg.InviteExpiry)
+	inviteLinkHandler := handlers.NewInviteLinkHandler(inviteLinkDAO, userDAO, publisher, cfg.AppURL)
+	noteHandler := notehandlers.NewNoteHandler(noteDAO, relationshipDAO, publisher)
+	socketHandler := realtimehandlers.NewSocketHandler(hub, api.AllowedOrigins)
+	streamHandler := realtimehandlers.NewStreamHandler(hub, eventLog)
 
 	// shutdown signals
 	c := make(chan os.Signal, 1)
@@ -64,6 +144,7 @@ func main() {
 	go func() {
 		<-c // wait for shutdown signal to be received
 		fmt.Println("\nShutting down gracefully...")
+		cancel()
 		database.Close()
 		os.Exit(0)
 	}()
@@ -84,7 +165,7 @@ func main() {
 
 	fmt.Printf("\n\tStarting server, listening at port :8000...\n\n")
 
-	r := api.RegisterRoutes(userHandler, relationshipHandler, inviteHandler, noteHandler, authMiddleware, permissionsMiddleware, presigner)
+	r := api.RegisterRoutes(userHandler, sessionHandler, mfaHandler, passkeyHandler, oauthHandler, keyHandler, relationshipHandler, inviteHandler, inviteLinkHandler, noteHandler, socketHandler, streamHandler, authMiddleware, permissionsMiddleware, rateLimiter, presigner, cfg.TrustProxy)
 	err = http.ListenAndServe(":8000", r)
 	if err != nil {
 		log.Fatalf("error: %v\n", err)
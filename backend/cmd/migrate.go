@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/migrate"
+	"github.com/theEricHoang/lovenote/backend/migrations"
+)
+
+const migrateUsage = `usage: main migrate <command>
+
+commands:
+  up                 apply all pending migrations
+  down [steps]       revert the last applied migration, or the last [steps] of them
+  status             list migrations and whether they have been applied
+  baseline <version> mark migrations up to <version> as applied without running them`
+
+// runMigrate handles `main migrate ...` and exits instead of starting the server
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+
+	database, err := db.NewDatabase()
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer database.Close()
+
+	ctx := context.Background()
+	migrator := migrate.NewMigrator(database, migrations.FS)
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		printMigrations("applied", applied)
+		if err != nil {
+			log.Fatalf("migrate up: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps: %s", args[1])
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		printMigrations("reverted", reverted)
+		if err != nil {
+			log.Fatalf("migrate down: %v", err)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("no migrations to revert")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatalf("migrate status: %v", err)
+		}
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%03d_%-40s %s\n", status.Version, status.Name, appliedAt)
+		}
+	case "baseline":
+		if len(args) < 2 {
+			log.Fatal("migrate baseline requires a version")
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid version: %s", args[1])
+		}
+
+		marked, err := migrator.Baseline(ctx, version)
+		printMigrations("marked as applied", marked)
+		if err != nil {
+			log.Fatalf("migrate baseline: %v", err)
+		}
+	default:
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+}
+
+func printMigrations(verb string, migrations []migrate.Migration) {
+	for _, migration := range migrations {
+		fmt.Printf("%s %03d_%s\n", verb, migration.Version, migration.Name)
+	}
+}
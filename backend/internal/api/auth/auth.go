@@ -6,92 +6,114 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	config "github.com/theEricHoang/lovenote/backend/internal"
+	"github.com/google/uuid"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/passhash"
 )
 
 var (
 	AccessTokenExpiry  = 15 * time.Minute
 	RefreshTokenExpiry = 7 * 24 * time.Hour
-	SecretKey          = []byte(config.LoadConfig().JWTSecretKey)
 )
 
 type AuthService struct {
-	DB *db.Database
+	DB          *db.Database
+	Revocations *RevocationList
+	Keys        *KeySet
+	Hasher      *passhash.Hasher
+	dummyHash   string
 }
 
+// token types, so a token issued for one purpose can't be passed off as another
+const (
+	TokenTypeAccess     = "access"
+	TokenTypeRefresh    = "refresh"
+	TokenTypeMFAPending = "mfa_pending"
+)
+
 type Claims struct {
-	UserId uint `json:"user_id"`
+	UserId    uint   `json:"user_id"`
+	SessionId string `json:"sid,omitempty"`
+	Type      string `json:"typ,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(db *db.Database) *AuthService {
-	return &AuthService{DB: db}
-}
-
-func insertRefreshToken(ctx context.Context, db db.Database, userID uint, tokenStr string, exp time.Time) error {
-	query := `
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)
-		ON CONFLICT (user_id) DO UPDATE
-		SET token = EXCLUDED.token, expires_at = EXCLUDED.expires_at
-	`
-	_, err := db.Pool.Exec(ctx, query, userID, tokenStr, exp)
+func NewAuthService(db *db.Database, revocations *RevocationList, keys *KeySet, hasher *passhash.Hasher) (*AuthService, error) {
+	// checked against when there's no real hash to check, so a missing account takes as long to
+	// reject as a wrong password
+	dummyHash, err := hasher.Hash("lovenote")
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return &AuthService{DB: db, Revocations: revocations, Keys: keys, Hasher: hasher, dummyHash: dummyHash}, nil
 }
 
-func (s *AuthService) GetRefreshToken(ctx context.Context, userID uint) (string, error) {
-	query := `
-		SELECT token FROM refresh_tokens WHERE user_id = $1
-	`
+func (s *AuthService) HashPassword(password string) (string, error) {
+	return s.Hasher.Hash(password)
+}
 
-	var token string
-	err := s.DB.Pool.QueryRow(ctx, query, userID).Scan(&token)
-	if err != nil {
-		return "", err
+func (s *AuthService) CheckPassword(hashedPassword, password string) error {
+	if hashedPassword == "" {
+		// accounts created through a login provider have no password
+		s.Hasher.Verify(s.dummyHash, password)
+		return passhash.ErrMismatch
 	}
+	return s.Hasher.Verify(hashedPassword, password)
+}
 
-	return token, nil
+// CheckDummyPassword does the same work as CheckPassword for a user that doesn't exist
+func (s *AuthService) CheckDummyPassword(password string) {
+	s.Hasher.Verify(s.dummyHash, password)
 }
 
-func (s *AuthService) HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(hashedPassword), err
+// PasswordNeedsRehash reports whether a hash that just checked out should be replaced with one
+// made under the current hashing policy
+func (s *AuthService) PasswordNeedsRehash(hashedPassword string) bool {
+	return hashedPassword != "" && s.Hasher.NeedsRehash(hashedPassword)
 }
 
-func (s *AuthService) CheckPassword(hashedPassword, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+// GenerateTokens starts a new session for the device and returns its access and refresh tokens
+func (s *AuthService) GenerateTokens(ctx context.Context, userId uint, device Device) (string, string, error) {
+	sessionId := uuid.New().String()
+	accessToken, refreshToken, err := s.generateTokenPair(userId, sessionId)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = insertSession(ctx, *s.DB, sessionId, userId, HashToken(refreshToken), device, time.Now().Add(RefreshTokenExpiry))
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
 }
 
-func (s *AuthService) GenerateTokens(ctx context.Context, userId uint) (string, string, error) {
+func (s *AuthService) generateTokenPair(userId uint, sessionId string) (string, string, error) {
 	accessClaims := Claims{
-		UserId: userId,
+		UserId:    userId,
+		SessionId: sessionId,
+		Type:      TokenTypeAccess,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenExpiry)),
 		},
 	}
-	accessToken, err := generateJWT(accessClaims)
+	accessToken, err := s.Keys.Sign(accessClaims)
 	if err != nil {
 		return "", "", err
 	}
 
 	refreshClaims := Claims{
-		UserId: userId,
+		UserId:    userId,
+		SessionId: sessionId,
+		Type:      TokenTypeRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
+			// every refresh token has to hash differently, even when rotated twice in the same second
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(RefreshTokenExpiry)),
 		},
 	}
-	refreshToken, err := generateJWT(refreshClaims)
-	if err != nil {
-		return "", "", err
-	}
-
-	err = insertRefreshToken(ctx, *s.DB, userId, refreshToken, time.Now().Add(RefreshTokenExpiry))
+	refreshToken, err := s.Keys.Sign(refreshClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -100,12 +122,11 @@ func (s *AuthService) GenerateTokens(ctx context.Context, userId uint) (string,
 }
 
 func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return SecretKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, s.Keys.keyFunc, jwt.WithValidMethods([]string{
+		jwt.SigningMethodHS256.Alg(),
+		jwt.SigningMethodRS256.Alg(),
+		jwt.SigningMethodEdDSA.Alg(),
+	}))
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +137,7 @@ func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-func generateJWT(claims Claims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(SecretKey)
+// IsRevoked reports whether the token or the session it belongs to was revoked before it expired
+func (s *AuthService) IsRevoked(claims *Claims) bool {
+	return s.Revocations.IsRevoked(claims.ID, claims.SessionId)
 }
@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type verificationKey struct {
+	Method jwt.SigningMethod
+	Public crypto.PublicKey
+}
+
+// KeySet holds the key new tokens are signed with and every key tokens are still accepted from.
+// with an asymmetric signing key each key is identified by its RFC 7638 thumbprint, sent as the
+// token's kid. without one, tokens are signed with the HS256 secret like before
+type KeySet struct {
+	signingKeyId  string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.PrivateKey
+	secret        []byte
+	keys          map[string]verificationKey
+}
+
+// JWK is the public half of a key as published in the JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeySet reads the signing key and any extra verification keys from the config. to rotate,
+// configure the new signing key and keep the old one as a verification key until every token
+// signed with it has expired
+func LoadKeySet(cfg config.Config) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]verificationKey{}}
+	if cfg.JWTSecretKey != "" {
+		ks.secret = []byte(cfg.JWTSecretKey)
+	}
+
+	signingPEM := []byte(cfg.JWTSigningKey)
+	if cfg.JWTSigningKeyFile != "" {
+		contents, err := os.ReadFile(cfg.JWTSigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key: %w", err)
+		}
+		signingPEM = contents
+	}
+
+	if len(signingPEM) > 0 {
+		private, err := parsePrivateKey(signingPEM)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signing key: %w", err)
+		}
+
+		public := private.(interface{ Public() crypto.PublicKey }).Public()
+		kid, method, err := ks.add(public)
+		if err != nil {
+			return nil, err
+		}
+		ks.signingKeyId = kid
+		ks.signingMethod = method
+		ks.signingKey = private
+	} else if ks.secret == nil {
+		return nil, errors.New("no JWT signing key or secret configured")
+	}
+
+	verificationPEMs := [][]byte{[]byte(cfg.JWTVerificationKeys)}
+	for _, path := range cfg.JWTVerificationKeyFiles {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading verification key: %w", err)
+		}
+		verificationPEMs = append(verificationPEMs, contents)
+	}
+
+	for _, contents := range verificationPEMs {
+		publics, err := parsePublicKeys(contents)
+		if err != nil {
+			return nil, fmt.Errorf("parsing verification keys: %w", err)
+		}
+		for _, public := range publics {
+			if _, _, err := ks.add(public); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) add(public crypto.PublicKey) (string, jwt.SigningMethod, error) {
+	var method jwt.SigningMethod
+	switch public.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return "", nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", public)
+	}
+
+	kid := toJWK(public, "", "").thumbprint()
+	ks.keys[kid] = verificationKey{Method: method, Public: public}
+	return kid, method, nil
+}
+
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	if ks.signingKey == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(ks.secret)
+	}
+
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	token.Header["kid"] = ks.signingKeyId
+	return token.SignedString(ks.signingKey)
+}
+
+// keyFunc picks the key a token has to be verified with: the one named by its kid, or the HS256
+// secret for tokens issued before asymmetric keys were configured
+func (ks *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if _, isHMAC := token.Method.(*jwt.SigningMethodHMAC); !isHMAC || ks.secret == nil {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return ks.secret, nil
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.Public, nil
+}
+
+// JWKS lists the public keys so other services can verify our tokens. the HS256 secret is never published
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for kid, key := range ks.keys {
+		jwks.Keys = append(jwks.Keys, toJWK(key.Public, kid, key.Method.Alg()))
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+	return jwks
+}
+
+func toJWK(public crypto.PublicKey, kid, alg string) JWK {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Kid: kid, Use: "sig", Alg: alg, N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: kid, Use: "sig", Alg: alg, Crv: "Ed25519", X: encode(key)}
+	}
+	return JWK{}
+}
+
+// thumbprint implements RFC 7638: a hash of the required members in lexicographic order
+func (k JWK) thumbprint() string {
+	var members any
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	}
+
+	raw, _ := json.Marshal(members)
+	sum := sha256.Sum256(raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func parsePrivateKey(contents []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey, ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", key)
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+}
+
+// parsePublicKeys accepts any number of concatenated public or private keys, returning the public half of each
+func parsePublicKeys(contents []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	rest := []byte(strings.TrimSpace(string(contents)))
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("invalid PEM data")
+		}
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		default:
+			private, err := parsePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, private.(interface{ Public() crypto.PublicKey }).Public())
+		}
+		rest = []byte(strings.TrimSpace(string(rest)))
+	}
+	return keys, nil
+}
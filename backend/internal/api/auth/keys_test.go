@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+)
+
+func TestThumbprint(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  JWK
+		want string
+	}{
+		{
+			// RFC 7638 section 3.1
+			name: "RSA",
+			jwk: JWK{
+				Kty: "RSA",
+				N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+				E:   "AQAB",
+				// members outside the RFC 7638 set don't change the thumbprint
+				Kid: "2011-04-29",
+				Alg: "RS256",
+			},
+			want: "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+		},
+		{
+			// RFC 8037 appendix A.3
+			name: "Ed25519",
+			jwk:  JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+			want: "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.jwk.thumbprint(); got != tt.want {
+				t.Errorf("thumbprint() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func pemBlock(t *testing.T, blockType string, der []byte, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ed25519: edKey, ecdsa: ecKey}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	keys := newTestKeys(t)
+	pkcs8 := func(key any) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		return pemBlock(t, "PRIVATE KEY", der, err)
+	}
+	edPublic, err := x509.MarshalPKIXPublicKey(keys.ed25519.Public())
+
+	tests := []struct {
+		name    string
+		pem     string
+		want    crypto.PublicKey
+		wantErr bool
+	}{
+		{"PKCS1 RSA", pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa), nil), keys.rsa.Public(), false},
+		{"PKCS8 RSA", pkcs8(keys.rsa), keys.rsa.Public(), false},
+		{"PKCS8 Ed25519", pkcs8(keys.ed25519), keys.ed25519.Public(), false},
+		{"PKCS8 ECDSA", pkcs8(keys.ecdsa), nil, true},
+		{"public key", pemBlock(t, "PUBLIC KEY", edPublic, err), nil, true},
+		{"not PEM", "not a key", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			private, err := parsePrivateKey([]byte(tt.pem))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrivateKey() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			public := private.(interface{ Public() crypto.PublicKey }).Public()
+			if !public.(interface{ Equal(crypto.PublicKey) bool }).Equal(tt.want) {
+				t.Error("parsed a different key")
+			}
+		})
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	edPKIX, edErr := x509.MarshalPKIXPublicKey(keys.ed25519.Public())
+	rsaPKIX, rsaErr := x509.MarshalPKIXPublicKey(keys.rsa.Public())
+	ecPKIX, ecErr := x509.MarshalPKIXPublicKey(keys.ecdsa.Public())
+	edPKCS8, edPrivErr := x509.MarshalPKCS8PrivateKey(keys.ed25519)
+
+	edPublic := pemBlock(t, "PUBLIC KEY", edPKIX, edErr)
+	rsaPublic := pemBlock(t, "PUBLIC KEY", rsaPKIX, rsaErr)
+	rsaPKCS1Public := pemBlock(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey), nil)
+	rsaPrivate := pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa), nil)
+	edPrivate := pemBlock(t, "PRIVATE KEY", edPKCS8, edPrivErr)
+
+	tests := []struct {
+		name    string
+		pem     string
+		want    []crypto.PublicKey
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"whitespace only", "\n  \n", nil, false},
+		{"one key", edPublic, []crypto.PublicKey{keys.ed25519.Public()}, false},
+		{
+			"several blocks",
+			edPublic + rsaPublic + rsaPKCS1Public,
+			[]crypto.PublicKey{keys.ed25519.Public(), keys.rsa.Public(), keys.rsa.Public()},
+			false,
+		},
+		{
+			"blank lines between blocks",
+			"\n" + rsaPublic + "\n\n" + edPublic + "\n",
+			[]crypto.PublicKey{keys.rsa.Public(), keys.ed25519.Public()},
+			false,
+		},
+		{
+			"private keys give their public half",
+			rsaPrivate + edPrivate,
+			[]crypto.PublicKey{keys.rsa.Public(), keys.ed25519.Public()},
+			false,
+		},
+		// the ECDSA key parses here and is refused when it's added to a key set
+		{"ECDSA public key", pemBlock(t, "PUBLIC KEY", ecPKIX, ecErr), []crypto.PublicKey{keys.ecdsa.Public()}, false},
+		{"garbage after a key", edPublic + "garbage", nil, true},
+		{"unknown block", pemBlock(t, "CERTIFICATE", []byte("x"), nil), nil, true},
+		{"corrupt key", pemBlock(t, "PUBLIC KEY", []byte("not der"), nil), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePublicKeys([]byte(tt.pem))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePublicKeys() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !got[i].(interface{ Equal(crypto.PublicKey) bool }).Equal(tt.want[i]) {
+					t.Errorf("key %d is a different key", i)
+				}
+			}
+		})
+	}
+}
+
+func signAndParse(t *testing.T, signer, verifier *KeySet) error {
+	t.Helper()
+	token, err := signer.Sign(Claims{
+		UserId:           1,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.ParseWithClaims(token, &Claims{}, verifier.keyFunc)
+	return err
+}
+
+// a rotation: tokens from the old key keep working once the new one signs, as long as the old
+// one is listed as a verification key
+func TestKeySetRotation(t *testing.T) {
+	keys := newTestKeys(t)
+	oldPKCS8, err := x509.MarshalPKCS8PrivateKey(keys.ed25519)
+	oldKey := pemBlock(t, "PRIVATE KEY", oldPKCS8, err)
+	newKey := pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa), nil)
+
+	// verification keys can also come from files
+	oldKeyFile := filepath.Join(t.TempDir(), "old.pem")
+	if err := os.WriteFile(oldKeyFile, []byte(oldKey), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := LoadKeySet(config.Config{JWTSecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := LoadKeySet(config.Config{JWTSigningKey: oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := LoadKeySet(config.Config{JWTSigningKey: newKey, JWTSecretKey: "secret", JWTVerificationKeyFiles: []string{oldKeyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterCleanup, err := LoadKeySet(config.Config{JWTSigningKey: newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		signer   *KeySet
+		verifier *KeySet
+		wantErr  bool
+	}{
+		{"old key before rotating", before, before, false},
+		{"old key during rotation", before, after, false},
+		{"HS256 during rotation", secret, after, false},
+		{"new key during rotation", after, after, false},
+		{"old key after dropping it", before, afterCleanup, true},
+		{"HS256 after dropping the secret", secret, afterCleanup, true},
+		{"new key on an instance that hasn't rotated", after, before, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := signAndParse(t, tt.signer, tt.verifier)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifying = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want the new and the old one", len(jwks.Keys))
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid != jwk.thumbprint() {
+			t.Errorf("kid %s isn't the key's thumbprint %s", jwk.Kid, jwk.thumbprint())
+		}
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	keys := newTestKeys(t)
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(keys.ecdsa)
+	ecKey := pemBlock(t, "PRIVATE KEY", ecPKCS8, err)
+	ecPKIX, err := x509.MarshalPKIXPublicKey(keys.ecdsa.Public())
+	ecPublic := pemBlock(t, "PUBLIC KEY", ecPKIX, err)
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want string
+	}{
+		{"nothing configured", config.Config{}, "no JWT signing key"},
+		{"unsupported signing key", config.Config{JWTSigningKey: ecKey}, "unsupported key type"},
+		{"unsupported verification key", config.Config{JWTSecretKey: "secret", JWTVerificationKeys: ecPublic}, "unsupported key type"},
+		{"missing key file", config.Config{JWTSigningKeyFile: filepath.Join(t.TempDir(), "missing.pem")}, "reading signing key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeySet(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadKeySet() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyFuncRejectsAlgorithmSwitch(t *testing.T) {
+	keys := newTestKeys(t)
+	ks, err := LoadKeySet(config.Config{JWTSigningKey: pemBlock(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa), nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token claiming the RSA key's kid but signed with HS256, using the public key as the secret
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserId: 1})
+	token.Header["kid"] = ks.signingKeyId
+	signed, err := token.SignedString(x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jwt.ParseWithClaims(signed, &Claims{}, ks.keyFunc)
+	if !errors.Is(err, jwt.ErrSignatureInvalid) && !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("parsing = %v, want an invalid signature", err)
+	}
+}
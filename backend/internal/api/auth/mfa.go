@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/totp"
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotSetUp       = errors.New("two-factor authentication has not been set up")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+	ErrInvalidMFAToken   = errors.New("invalid mfa token")
+)
+
+const (
+	// how long someone has to enter their code after getting their password right
+	MFATokenExpiry = 5 * time.Minute
+	// wrong codes allowed per login before the password has to be entered again
+	MaxMFAAttempts = 5
+
+	RecoveryCodeCount = 10
+)
+
+type MFAStatus struct {
+	Enabled                bool `json:"enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+func (s *AuthService) GetMFAStatus(ctx context.Context, userId uint) (*MFAStatus, error) {
+	var status MFAStatus
+	query := `
+		SELECT
+			EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND enabled_at IS NOT NULL),
+			(SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	`
+	err := s.DB.Pool.QueryRow(ctx, query, userId).Scan(&status.Enabled, &status.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (s *AuthService) IsMFAEnabled(ctx context.Context, userId uint) (bool, error) {
+	status, err := s.GetMFAStatus(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled, nil
+}
+
+// BeginMFASetup generates a new authenticator secret for the user. it isn't used for logins until
+// EnableMFA confirms they saved it
+func (s *AuthService) BeginMFASetup(ctx context.Context, userId uint) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = CURRENT_TIMESTAMP
+		WHERE user_mfa.enabled_at IS NULL
+	`
+	tag, err := s.DB.Pool.Exec(ctx, query, userId, secret)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrMFAAlreadyEnabled
+	}
+
+	return secret, nil
+}
+
+// EnableMFA turns two-factor authentication on once the user proves their authenticator works,
+// returning their first set of recovery codes
+func (s *AuthService) EnableMFA(ctx context.Context, userId uint, code string) ([]string, error) {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var secret string
+	var enabled bool
+	query := "SELECT secret, enabled_at IS NOT NULL FROM user_mfa WHERE user_id = $1 FOR UPDATE"
+	err = tx.QueryRow(ctx, query, userId).Scan(&secret, &enabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFANotSetUp
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	query = "UPDATE user_mfa SET enabled_at = CURRENT_TIMESTAMP, last_used_step = $2, failed_attempts = 0 WHERE user_id = $1"
+	_, err = tx.Exec(ctx, query, userId, step)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+func (s *AuthService) DisableMFA(ctx context.Context, userId uint) error {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM user_mfa WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code the user has, used or not
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userId uint) ([]string, error) {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userId uint) ([]string, error) {
+	_, err := tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		codes[i], err = newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		query := "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)"
+		_, err = tx.Exec(ctx, query, userId, HashToken(normalizeRecoveryCode(codes[i])))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// newRecoveryCode returns 50 random bits formatted as xxxxx-xxxxx, easy enough to type off paper
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 7)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// VerifyMFA checks a code from the user's authenticator, or one of their recovery codes, which is
+// used up. authenticator codes can't be replayed either
+func (s *AuthService) VerifyMFA(ctx context.Context, userId uint, code string) error {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var secret string
+	var lastUsedStep int64
+	query := "SELECT secret, last_used_step FROM user_mfa WHERE user_id = $1 AND enabled_at IS NOT NULL FOR UPDATE"
+	err = tx.QueryRow(ctx, query, userId).Scan(&secret, &lastUsedStep)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrMFANotSetUp
+	}
+	if err != nil {
+		return err
+	}
+
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		if step <= lastUsedStep {
+			return ErrInvalidMFACode
+		}
+
+		query = "UPDATE user_mfa SET last_used_step = $2, failed_attempts = 0 WHERE user_id = $1"
+		_, err = tx.Exec(ctx, query, userId, step)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	query = `
+		UPDATE mfa_recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	tag, err := tx.Exec(ctx, query, userId, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidMFACode
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE user_mfa SET failed_attempts = 0 WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GenerateMFAToken issues the short lived token a login gets in exchange for the right password
+// when the account has two-factor authentication on. it can't be used as an access token
+func (s *AuthService) GenerateMFAToken(userId uint) (string, error) {
+	return s.Keys.Sign(Claims{
+		UserId: userId,
+		Type:   TokenTypeMFAPending,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(MFATokenExpiry)),
+		},
+	})
+}
+
+func (s *AuthService) validateMFAToken(mfaToken string) (*Claims, error) {
+	claims, err := s.ValidateToken(mfaToken)
+	if err != nil || claims.Type != TokenTypeMFAPending || s.IsRevoked(claims) {
+		return nil, ErrInvalidMFAToken
+	}
+	return claims, nil
+}
+
+// MFATokenUser returns whose login a pending token belongs to, so the account's lockout can be
+// checked before any code is
+func (s *AuthService) MFATokenUser(mfaToken string) (uint, error) {
+	claims, err := s.validateMFAToken(mfaToken)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserId, nil
+}
+
+// CompleteMFALogin checks the code for a pending login and starts a session when it's right. the
+// pending token is single use, and stops working after too many wrong codes. that alone doesn't
+// stop someone with the password from logging in again for a new token, so callers also count
+// wrong codes as failed logins
+func (s *AuthService) CompleteMFALogin(ctx context.Context, mfaToken, code string, device Device) (uint, string, string, error) {
+	claims, err := s.validateMFAToken(mfaToken)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	err = s.VerifyMFA(ctx, claims.UserId, code)
+	if err == ErrInvalidMFACode {
+		var attempts int
+		query := "UPDATE user_mfa SET failed_attempts = failed_attempts + 1 WHERE user_id = $1 RETURNING failed_attempts"
+		err = s.DB.Pool.QueryRow(ctx, query, claims.UserId).Scan(&attempts)
+		if err != nil {
+			return 0, "", "", err
+		}
+
+		if attempts >= MaxMFAAttempts {
+			_, err = s.DB.Pool.Exec(ctx, "UPDATE user_mfa SET failed_attempts = 0 WHERE user_id = $1", claims.UserId)
+			if err != nil {
+				return 0, "", "", err
+			}
+			err = s.Revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time)
+			if err != nil {
+				return 0, "", "", err
+			}
+			return 0, "", "", ErrInvalidMFAToken
+		}
+		return 0, "", "", ErrInvalidMFACode
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	err = s.Revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	accessToken, refreshToken, err := s.GenerateTokens(ctx, claims.UserId, device)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	return claims.UserId, accessToken, refreshToken, nil
+}
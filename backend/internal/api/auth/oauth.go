@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrUnknownOAuthProvider = errors.New("unknown oauth provider")
+	ErrInvalidOAuthState    = errors.New("invalid or expired oauth state")
+	ErrOAuthNoEmail         = errors.New("provider did not share a verified email")
+	ErrOAuthEmailInUse      = errors.New("email belongs to an account that can't be linked automatically")
+)
+
+// how long someone has to finish signing in at the provider
+const OAuthStateExpiry = 10 * time.Minute
+
+// same picture RegisterHandler falls back to
+const defaultProfilePicture = "https://img.freepik.com/free-vector/gradient-heart_78370-478.jpg"
+
+// OAuthService signs users in through external identity providers using the authorization code
+// flow with PKCE. the state, verifier and nonce for each attempt are kept server side
+type OAuthService struct {
+	DB        *db.Database
+	Providers map[string]OAuthProvider
+}
+
+func NewOAuthService(database *db.Database, cfg config.Config) (*OAuthService, error) {
+	providers := map[string]OAuthProvider{}
+	for _, providerCfg := range cfg.OAuthProviders {
+		redirectURL := fmt.Sprintf("%s/api/auth/oauth/%s/callback", strings.TrimSuffix(cfg.APIURL, "/"), providerCfg.Name)
+		provider, err := NewOAuthProvider(providerCfg, redirectURL)
+		if err != nil {
+			return nil, err
+		}
+		providers[providerCfg.Name] = provider
+	}
+	return &OAuthService{DB: database, Providers: providers}, nil
+}
+
+func (s *OAuthService) ProviderNames() []string {
+	names := []string{}
+	for name := range s.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Begin starts a login with the provider, returning where to send the browser and the state it
+// has to come back with
+func (s *OAuthService) Begin(ctx context.Context, providerName string) (string, string, error) {
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownOAuthProvider
+	}
+
+	state, stateHash, err := NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, _, err := NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	query := `
+		INSERT INTO oauth_states (state_hash, provider, code_verifier, nonce, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+	`
+	_, err = s.DB.Pool.Exec(ctx, query, stateHash, providerName, verifier, nonce, OAuthStateExpiry.Seconds())
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = s.DB.Pool.Exec(ctx, "DELETE FROM oauth_states WHERE expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return "", "", err
+	}
+
+	return authURL, state, nil
+}
+
+// Complete finishes a login the provider redirected back from and returns the lovenote user it
+// belongs to, linking or creating one the first time an identity is seen
+func (s *OAuthService) Complete(ctx context.Context, providerName, state, code string) (uint, error) {
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return 0, ErrUnknownOAuthProvider
+	}
+
+	// each state can only be redeemed once
+	var verifier, nonce string
+	query := `
+		DELETE FROM oauth_states
+		WHERE state_hash = $1 AND provider = $2 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING code_verifier, nonce
+	`
+	err := s.DB.Pool.QueryRow(ctx, query, HashToken(state), providerName).Scan(&verifier, &nonce)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrInvalidOAuthState
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	identity, err := provider.Exchange(ctx, code, nonce, verifier)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.resolveUser(ctx, providerName, identity)
+}
+
+func (s *OAuthService) resolveUser(ctx context.Context, providerName string, identity *ExternalIdentity) (uint, error) {
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userId uint
+	query := `
+		UPDATE user_identities SET last_used_at = CURRENT_TIMESTAMP
+		WHERE provider = $1 AND subject = $2
+		RETURNING user_id
+	`
+	err = tx.QueryRow(ctx, query, providerName, identity.Subject).Scan(&userId)
+	if err == nil {
+		return userId, tx.Commit(ctx)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return 0, ErrOAuthNoEmail
+	}
+
+	// only link to an account whose owner proved they have the address too, otherwise someone could
+	// sign up with a victim's email ahead of time and be handed their account when they show up
+	var emailVerified bool
+	query = "SELECT id, email_verified FROM users WHERE LOWER(email) = LOWER($1) FOR UPDATE"
+	err = tx.QueryRow(ctx, query, identity.Email).Scan(&userId, &emailVerified)
+	if err == nil && !emailVerified {
+		return 0, ErrOAuthEmailInUse
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		userId, err = createOAuthUser(ctx, tx, identity)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	query = `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_used_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+	`
+	_, err = tx.Exec(ctx, query, userId, providerName, identity.Subject, identity.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, tx.Commit(ctx)
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// createOAuthUser signs up a new user with no password. they can set one with a password reset
+func createOAuthUser(ctx context.Context, tx pgx.Tx, identity *ExternalIdentity) (uint, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	// leave room for the suffix and stay within the username rules
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if len(base) > 26 {
+		base = base[:26]
+	}
+	if len(base) < 3 {
+		base = "user" + base
+	}
+
+	picture := identity.Picture
+	if picture == "" {
+		picture = defaultProfilePicture
+	}
+
+	query := `
+		INSERT INTO users (username, email, email_verified, profile_picture, password_hash)
+		VALUES ($1, $2, TRUE, $3, '')
+		ON CONFLICT (username) DO NOTHING
+		RETURNING id
+	`
+	username := base
+	for range 10 {
+		var userId uint
+		err := tx.QueryRow(ctx, query, username, identity.Email, picture).Scan(&userId)
+		if err == nil {
+			return userId, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, err
+		}
+
+		suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return 0, err
+		}
+		username = fmt.Sprintf("%s%04d", base, suffix.Int64())
+	}
+	return 0, errors.New("could not find a free username")
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+var ErrOAuthNonceMismatch = errors.New("id token nonce does not match")
+
+// ExternalIdentity is who the provider says just signed in
+type ExternalIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Picture       string
+}
+
+// OAuthProvider runs the authorization code flow against one identity provider
+type OAuthProvider interface {
+	// AuthCodeURL is where the browser gets sent to sign in
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	// Exchange redeems the code the provider redirected back with
+	Exchange(ctx context.Context, code, nonce, verifier string) (*ExternalIdentity, error)
+}
+
+// NewOAuthProvider picks the implementation for a configured provider. github has its own since it
+// doesn't support OIDC, everything else is discovered from its issuer
+func NewOAuthProvider(cfg config.OAuthProviderConfig, redirectURL string) (OAuthProvider, error) {
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("oauth provider %s has no client id", cfg.Name)
+	}
+
+	if cfg.Name == "github" {
+		scopes := cfg.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"read:user", "user:email"}
+		}
+		return &githubProvider{oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     endpoints.GitHub,
+			RedirectURL:  redirectURL,
+			Scopes:       scopes,
+		}}, nil
+	}
+
+	if cfg.Issuer == "" {
+		return nil, fmt.Errorf("oauth provider %s has no issuer", cfg.Name)
+	}
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	return &oidcProvider{issuer: cfg.Issuer, oauth: oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}}, nil
+}
+
+type oidcProvider struct {
+	issuer string
+
+	// discovery happens on first use so a provider being down doesn't stop the server from starting
+	mu       sync.Mutex
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.verifier == nil {
+		// the provider keeps using this context to refresh its signing keys, so it can't be the request's
+		provider, err := oidc.NewProvider(context.WithoutCancel(ctx), p.issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.oauth.Endpoint = provider.Endpoint()
+		p.verifier = provider.Verifier(&oidc.Config{ClientID: p.oauth.ClientID})
+	}
+
+	oauth := p.oauth
+	return &oauth, p.verifier, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	oauth, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, nonce, verifier string) (*ExternalIdentity, error) {
+	oauth, idVerifier, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no id_token")
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, ErrOAuthNonceMismatch
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     any    `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+		Picture           string `json:"picture"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Name
+	}
+	return &ExternalIdentity{
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: isTrue(claims.EmailVerified),
+		Username:      username,
+		Picture:       claims.Picture,
+	}, nil
+}
+
+// isTrue handles providers that send email_verified as a string
+func isTrue(value any) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+type githubProvider struct {
+	oauth oauth2.Config
+}
+
+func (p *githubProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	return p.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), nil
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code, nonce, verifier string) (*ExternalIdentity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, err
+	}
+	client := p.oauth.Client(ctx, token)
+
+	var user struct {
+		Id        int64  `json:"id"`
+		Login     string `json:"login"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(client, "https://api.github.com/user", &user); err != nil {
+		return nil, err
+	}
+
+	// the profile email is whatever the user made public, the primary one from here is the one github verified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, "https://api.github.com/user/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	identity := &ExternalIdentity{
+		Subject:  strconv.FormatInt(user.Id, 10),
+		Username: user.Login,
+		Picture:  user.AvatarURL,
+	}
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+	return identity, nil
+}
+
+func getJSON(client *http.Client, url string, v any) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testClientID     = "lovenote"
+	testClientSecret = "client secret"
+	testRedirectURL  = "https://lovenote.example/api/auth/oauth/test/callback"
+)
+
+// fakeIssuer is just enough of an OIDC provider for the authorization code flow with PKCE
+type fakeIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]fakeGrant
+	// claims changes what goes into the next id token
+	claims func(claims jwt.MapClaims)
+}
+
+// what the browser was sent to /authorize with, which the code gets tied to
+type fakeGrant struct {
+	challenge string
+	nonce     string
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{key: key, grants: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, http.StatusOK, map[string]any{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/authorize",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, http.StatusOK, JWKS{Keys: []JWK{toJWK(&key.PublicKey, "test", "RS256")}})
+	})
+	mux.HandleFunc("POST /token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorize plays the user signing in at authURL and returns the code the provider would redirect back with
+func (f *fakeIssuer) authorize(t *testing.T, authURL string) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != f.server.URL+"/authorize" {
+		t.Fatalf("sent to %s, want the issuer's authorization endpoint", got)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(f.grants))
+	f.grants[code] = fakeGrant{challenge: u.Query().Get("code_challenge"), nonce: u.Query().Get("nonce")}
+	return code
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != testClientID || clientSecret != testClientSecret {
+		writeTestJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	f.mu.Lock()
+	grant, ok := f.grants[r.PostFormValue("code")]
+	delete(f.grants, r.PostFormValue("code"))
+	claimsFunc := f.claims
+	f.mu.Unlock()
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectURL ||
+		oauth2.S256ChallengeFromVerifier(r.PostFormValue("code_verifier")) != grant.challenge {
+		writeTestJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                f.server.URL,
+		"sub":                "248289761001",
+		"aud":                testClientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              grant.nonce,
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "jane",
+		"name":               "Jane Doe",
+		"picture":            "https://example.com/jane.png",
+	}
+	if claimsFunc != nil {
+		claimsFunc(claims)
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = "test"
+	signed, err := idToken.SignedString(f.key)
+	if err != nil {
+		writeTestJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	writeTestJSON(w, http.StatusOK, map[string]any{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+func newTestOIDCProvider(t *testing.T, issuer string) OAuthProvider {
+	t.Helper()
+	provider, err := NewOAuthProvider(config.OAuthProviderConfig{
+		Name:         "test",
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		Issuer:       issuer,
+	}, testRedirectURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestNewOAuthProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.OAuthProviderConfig
+		wantErr bool
+	}{
+		{"oidc", config.OAuthProviderConfig{Name: "google", ClientID: "id", Issuer: "https://accounts.google.com"}, false},
+		{"github needs no issuer", config.OAuthProviderConfig{Name: "github", ClientID: "id"}, false},
+		{"no client id", config.OAuthProviderConfig{Name: "google", Issuer: "https://accounts.google.com"}, true},
+		{"no issuer", config.OAuthProviderConfig{Name: "google", ClientID: "id"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// discovery is lazy, so none of these reach the network
+			_, err := NewOAuthProvider(tt.cfg, testRedirectURL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewOAuthProvider() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderAuthCodeURL(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := newTestOIDCProvider(t, issuer.server.URL)
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "the state", "the nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"response_type":         "code",
+		"scope":                 "openid email profile",
+		"state":                 "the state",
+		"nonce":                 "the nonce",
+		"code_challenge":        oauth2.S256ChallengeFromVerifier(verifier),
+		"code_challenge_method": "S256",
+	}
+	for key, value := range want {
+		if got := u.Query().Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if u.Query().Has("code_verifier") {
+		t.Error("the code verifier was sent to the browser")
+	}
+}
+
+func TestOIDCProviderIssuerDown(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := newTestOIDCProvider(t, issuer.server.URL)
+	issuer.server.Close()
+
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", oauth2.GenerateVerifier()); err == nil {
+		t.Error("AuthCodeURL worked without reaching the issuer")
+	}
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	jane := &ExternalIdentity{
+		Subject:       "248289761001",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		Username:      "jane",
+		Picture:       "https://example.com/jane.png",
+	}
+
+	tests := []struct {
+		name string
+		// claims changes the id token the issuer hands out
+		claims func(claims jwt.MapClaims)
+		// exchange changes the nonce and verifier the callback passes on
+		exchange func(nonce, verifier string) (string, string)
+		want     *ExternalIdentity
+		wantErr  error
+	}{
+		{name: "signs in", want: jane},
+		{
+			name:   "email_verified as a string",
+			claims: func(c jwt.MapClaims) { c["email_verified"] = "true" },
+			want:   jane,
+		},
+		{
+			name:   "unverified email",
+			claims: func(c jwt.MapClaims) { c["email_verified"] = false },
+			want:   &ExternalIdentity{Subject: jane.Subject, Email: jane.Email, Username: jane.Username, Picture: jane.Picture},
+		},
+		{
+			name:   "falls back to the name",
+			claims: func(c jwt.MapClaims) { delete(c, "preferred_username") },
+			want:   &ExternalIdentity{Subject: jane.Subject, Email: jane.Email, EmailVerified: true, Username: "Jane Doe", Picture: jane.Picture},
+		},
+		{
+			name:     "nonce from another attempt",
+			exchange: func(nonce, verifier string) (string, string) { return "another nonce", verifier },
+			wantErr:  ErrOAuthNonceMismatch,
+		},
+		{
+			name:    "id token without a nonce",
+			claims:  func(c jwt.MapClaims) { delete(c, "nonce") },
+			wantErr: ErrOAuthNonceMismatch,
+		},
+		{
+			name:     "wrong code verifier",
+			exchange: func(nonce, verifier string) (string, string) { return nonce, oauth2.GenerateVerifier() },
+			wantErr:  errAny,
+		},
+		{
+			name:    "token for another client",
+			claims:  func(c jwt.MapClaims) { c["aud"] = "someone else" },
+			wantErr: errAny,
+		},
+		{
+			name:    "token from another issuer",
+			claims:  func(c jwt.MapClaims) { c["iss"] = "https://evil.example" },
+			wantErr: errAny,
+		},
+		{
+			name:    "expired token",
+			claims:  func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			wantErr: errAny,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newFakeIssuer(t)
+			issuer.claims = tt.claims
+			provider := newTestOIDCProvider(t, issuer.server.URL)
+			ctx := context.Background()
+
+			nonce, verifier := "nonce", oauth2.GenerateVerifier()
+			authURL, err := provider.AuthCodeURL(ctx, "state", nonce, verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := issuer.authorize(t, authURL)
+
+			if tt.exchange != nil {
+				nonce, verifier = tt.exchange(nonce, verifier)
+			}
+			identity, err := provider.Exchange(ctx, code, nonce, verifier)
+
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Fatalf("Exchange() = %+v, want an error", identity)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Exchange() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("Exchange() error = %v", err)
+			case !reflect.DeepEqual(identity, tt.want):
+				t.Errorf("Exchange() = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+// errAny stands for any error in tests where which one depends on the oidc library
+var errAny = errors.New("any error")
+
+func TestOIDCProviderCodeUsedOnce(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	provider := newTestOIDCProvider(t, issuer.server.URL)
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := issuer.authorize(t, authURL)
+
+	if _, err := provider.Exchange(ctx, code, "nonce", verifier); err != nil {
+		t.Fatal(err)
+	}
+	_, err = provider.Exchange(ctx, code, "nonce", verifier)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("redeeming a code twice = %v, want invalid_grant", err)
+	}
+}
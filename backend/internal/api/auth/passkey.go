@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+var (
+	ErrInvalidCeremony  = errors.New("invalid or expired passkey ceremony")
+	ErrInvalidPasskey   = errors.New("invalid passkey")
+	ErrPasskeyNotFound  = errors.New("passkey not found")
+	ErrPasskeyDuplicate = errors.New("passkey already registered")
+)
+
+// how long the browser has to finish a ceremony once it has the challenge
+const CeremonyExpiry = 5 * time.Minute
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+)
+
+// Passkey is what users see of their WebAuthn credentials
+type Passkey struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// PasskeyService runs the WebAuthn registration and login ceremonies. a passkey login ends in the
+// same kind of session a password login does
+type PasskeyService struct {
+	DB          *db.Database
+	AuthService *AuthService
+	WebAuthn    *webauthn.WebAuthn
+}
+
+func NewPasskeyService(database *db.Database, authService *AuthService, cfg config.Config) (*PasskeyService, error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthnRPID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     cfg.WebAuthnOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PasskeyService{DB: database, AuthService: authService, WebAuthn: w}, nil
+}
+
+// passkeyUser adapts a user and their credentials to what the webauthn library expects
+type passkeyUser struct {
+	id          uint
+	handle      []byte
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return u.handle }
+func (u *passkeyUser) WebAuthnName() string                       { return u.name }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.name }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func (s *PasskeyService) loadUser(ctx context.Context, query string, arg any) (*passkeyUser, error) {
+	var user passkeyUser
+	err := s.DB.Pool.QueryRow(ctx, query, arg).Scan(&user.id, &user.handle, &user.name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Pool.Query(ctx, "SELECT credential FROM webauthn_credentials WHERE user_id = $1", user.id)
+	if err != nil {
+		return nil, err
+	}
+	user.credentials, err = pgx.CollectRows(rows, pgx.RowTo[webauthn.Credential])
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// saveCeremony stores the session data for a begin call and returns the id the finish call has to send back
+func (s *PasskeyService) saveCeremony(ctx context.Context, userId *uint, kind string, session *webauthn.SessionData) (string, error) {
+	id := uuid.New().String()
+	query := `
+		INSERT INTO webauthn_ceremonies (id, user_id, kind, session, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))
+	`
+	_, err := s.DB.Pool.Exec(ctx, query, id, userId, kind, session, CeremonyExpiry.Seconds())
+	if err != nil {
+		return "", err
+	}
+
+	// nobody else cleans these up, and abandoned ceremonies are common
+	_, err = s.DB.Pool.Exec(ctx, "DELETE FROM webauthn_ceremonies WHERE expires_at <= CURRENT_TIMESTAMP")
+	return id, err
+}
+
+// takeCeremony removes a ceremony so its challenge can only ever be answered once
+func (s *PasskeyService) takeCeremony(ctx context.Context, ceremonyId string, userId *uint, kind string) (*webauthn.SessionData, error) {
+	if _, err := uuid.Parse(ceremonyId); err != nil {
+		return nil, ErrInvalidCeremony
+	}
+
+	var session webauthn.SessionData
+	query := `
+		DELETE FROM webauthn_ceremonies
+		WHERE id = $1 AND kind = $2 AND user_id IS NOT DISTINCT FROM $3 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING session
+	`
+	err := s.DB.Pool.QueryRow(ctx, query, ceremonyId, kind, userId).Scan(&session)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidCeremony
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create() and the ceremony id to finish with
+func (s *PasskeyService) BeginRegistration(ctx context.Context, userId uint) (*protocol.CredentialCreation, string, error) {
+	// users get their random handle the first time they register a passkey
+	handle := make([]byte, 64)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, "", err
+	}
+	_, err := s.DB.Pool.Exec(ctx, "UPDATE users SET webauthn_handle = $2 WHERE id = $1 AND webauthn_handle IS NULL", userId, handle)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user, err := s.loadUser(ctx, "SELECT id, webauthn_handle, username FROM users WHERE id = $1", userId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	options, session, err := s.WebAuthn.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ceremonyId, err := s.saveCeremony(ctx, &userId, ceremonyRegistration, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, ceremonyId, nil
+}
+
+// FinishRegistration verifies the browser's response to a registration ceremony and saves the new passkey
+func (s *PasskeyService) FinishRegistration(ctx context.Context, userId uint, ceremonyId, name string, response []byte) (*Passkey, error) {
+	session, err := s.takeCeremony(ctx, ceremonyId, &userId, ceremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+
+	user, err := s.loadUser(ctx, "SELECT id, webauthn_handle, username FROM users WHERE id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.WebAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, ErrInvalidPasskey
+	}
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey := Passkey{Name: name}
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, name, credential)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (credential_id) DO NOTHING
+		RETURNING id, created_at
+	`
+	err = s.DB.Pool.QueryRow(ctx, query, userId, credential.ID, name, raw).Scan(&passkey.Id, &passkey.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPasskeyDuplicate
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &passkey, nil
+}
+
+// BeginLogin starts a usernameless login, the authenticator picks which passkey to use
+func (s *PasskeyService) BeginLogin(ctx context.Context) (*protocol.CredentialAssertion, string, error) {
+	options, session, err := s.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, "", err
+	}
+
+	ceremonyId, err := s.saveCeremony(ctx, nil, ceremonyLogin, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return options, ceremonyId, nil
+}
+
+// FinishLogin verifies the browser's assertion and starts a session for the passkey's owner. the
+// passkey already proves possession and user verification, so it stands in for the password and
+// the second factor alike
+func (s *PasskeyService) FinishLogin(ctx context.Context, ceremonyId string, response []byte, device Device) (uint, string, string, error) {
+	session, err := s.takeCeremony(ctx, ceremonyId, nil, ceremonyLogin)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return 0, "", "", ErrInvalidPasskey
+	}
+
+	var owner *passkeyUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err := s.loadUser(ctx, "SELECT id, webauthn_handle, username FROM users WHERE webauthn_handle = $1", userHandle)
+		if err != nil {
+			return nil, err
+		}
+		owner = user
+		return user, nil
+	}
+
+	_, credential, err := s.WebAuthn.ValidatePasskeyLogin(handler, *session, parsed)
+	if err != nil {
+		return 0, "", "", ErrInvalidPasskey
+	}
+	// a sign count going backwards means the authenticator may have been cloned
+	if credential.Authenticator.CloneWarning {
+		return 0, "", "", ErrInvalidPasskey
+	}
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		return 0, "", "", err
+	}
+	query := `
+		UPDATE webauthn_credentials SET credential = $3, last_used_at = CURRENT_TIMESTAMP
+		WHERE credential_id = $1 AND user_id = $2
+	`
+	_, err = s.DB.Pool.Exec(ctx, query, credential.ID, owner.id, raw)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	accessToken, refreshToken, err := s.AuthService.GenerateTokens(ctx, owner.id, device)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	return owner.id, accessToken, refreshToken, nil
+}
+
+func (s *PasskeyService) ListPasskeys(ctx context.Context, userId uint) ([]Passkey, error) {
+	query := `
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at
+	`
+	rows, err := s.DB.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var passkey Passkey
+		if err := rows.Scan(&passkey.Id, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+func (s *PasskeyService) DeletePasskey(ctx context.Context, userId, passkeyId uint) error {
+	tag, err := s.DB.Pool.Exec(ctx, "DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", passkeyId, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
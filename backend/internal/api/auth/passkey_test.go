@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/migrate"
+	"github.com/theEricHoang/lovenote/backend/migrations"
+)
+
+func TestNewPasskeyService(t *testing.T) {
+	valid := func() config.Config {
+		return config.Config{
+			WebAuthnRPID:    "lovenote.example",
+			WebAuthnRPName:  "lovenote",
+			WebAuthnOrigins: []string{"https://lovenote.example"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(cfg *config.Config)
+		wantErr bool
+	}{
+		{"valid", func(cfg *config.Config) {}, false},
+		{"several origins", func(cfg *config.Config) {
+			cfg.WebAuthnOrigins = append(cfg.WebAuthnOrigins, "https://app.lovenote.example")
+		}, false},
+		{"malformed relying party id", func(cfg *config.Config) { cfg.WebAuthnRPID = "%zz" }, true},
+		{"no origins", func(cfg *config.Config) { cfg.WebAuthnOrigins = nil }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(&cfg)
+			// the database is only used once a ceremony starts
+			_, err := NewPasskeyService(nil, nil, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPasskeyService() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFinishMalformedCeremony(t *testing.T) {
+	// ids that aren't uuids are turned away before the database is asked
+	s := &PasskeyService{}
+	for _, id := range []string{"", "not-a-uuid", "1", "' OR 1=1 --"} {
+		t.Run(id, func(t *testing.T) {
+			if _, _, _, err := s.FinishLogin(context.Background(), id, []byte("{}"), Device{}); !errors.Is(err, ErrInvalidCeremony) {
+				t.Errorf("FinishLogin() error = %v, want ErrInvalidCeremony", err)
+			}
+			if _, err := s.FinishRegistration(context.Background(), 1, id, "phone", []byte("{}")); !errors.Is(err, ErrInvalidCeremony) {
+				t.Errorf("FinishRegistration() error = %v, want ErrInvalidCeremony", err)
+			}
+		})
+	}
+}
+
+// newTestPasskeyService connects to TEST_DATABASE_URL and migrates it, skipping the test when
+// it isn't set
+func newTestPasskeyService(t *testing.T) *PasskeyService {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	database := &db.Database{Pool: pool}
+	if _, err := migrate.NewMigrator(database, migrations.FS).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewPasskeyService(database, nil, config.Config{
+		WebAuthnRPID:    "lovenote.example",
+		WebAuthnRPName:  "lovenote",
+		WebAuthnOrigins: []string{"https://lovenote.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoginCeremony(t *testing.T) {
+	s := newTestPasskeyService(t)
+	ctx := context.Background()
+
+	// a response that doesn't parse gets ErrInvalidPasskey, which is only reached once the
+	// ceremony has been taken
+	finish := func(ceremonyId string) error {
+		_, _, _, err := s.FinishLogin(ctx, ceremonyId, []byte("{}"), Device{})
+		return err
+	}
+	begin := func() string {
+		options, ceremonyId, err := s.BeginLogin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(options.Response.Challenge) == 0 {
+			t.Fatal("BeginLogin() handed out no challenge")
+		}
+		return ceremonyId
+	}
+
+	t.Run("used once", func(t *testing.T) {
+		ceremonyId := begin()
+		if err := finish(ceremonyId); !errors.Is(err, ErrInvalidPasskey) {
+			t.Fatalf("first FinishLogin() error = %v, want ErrInvalidPasskey", err)
+		}
+		if err := finish(ceremonyId); !errors.Is(err, ErrInvalidCeremony) {
+			t.Errorf("second FinishLogin() error = %v, want ErrInvalidCeremony", err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if err := finish(uuid.New().String()); !errors.Is(err, ErrInvalidCeremony) {
+			t.Errorf("FinishLogin() error = %v, want ErrInvalidCeremony", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		ceremonyId := begin()
+		_, err := s.DB.Pool.Exec(ctx, "UPDATE webauthn_ceremonies SET expires_at = CURRENT_TIMESTAMP - INTERVAL '1 second' WHERE id = $1", ceremonyId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := finish(ceremonyId); !errors.Is(err, ErrInvalidCeremony) {
+			t.Errorf("FinishLogin() error = %v, want ErrInvalidCeremony", err)
+		}
+	})
+
+	t.Run("not for registration", func(t *testing.T) {
+		ceremonyId := begin()
+		if _, err := s.FinishRegistration(ctx, 1, ceremonyId, "phone", []byte("{}")); !errors.Is(err, ErrInvalidCeremony) {
+			t.Errorf("FinishRegistration() error = %v, want ErrInvalidCeremony", err)
+		}
+		// and trying it there doesn't use it up
+		if err := finish(ceremonyId); !errors.Is(err, ErrInvalidPasskey) {
+			t.Errorf("FinishLogin() error = %v, want ErrInvalidPasskey", err)
+		}
+	})
+
+	t.Run("separate challenges", func(t *testing.T) {
+		first, firstId, err := s.BeginLogin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, secondId, err := s.BeginLogin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if firstId == secondId || first.Response.Challenge.String() == second.Response.Challenge.String() {
+			t.Error("two logins shared a ceremony or challenge")
+		}
+	})
+}
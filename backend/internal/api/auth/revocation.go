@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/eventbus"
+)
+
+type revocation struct {
+	Id        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RevocationList tracks access tokens and sessions that were revoked before their access tokens
+// expired. postgres is the source of truth; every instance keeps an in-memory copy so checking a
+// request never touches the database, and new revocations reach the other instances over the bus
+type RevocationList struct {
+	DB  *db.Database
+	Bus *eventbus.Bus
+
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+}
+
+func NewRevocationList(database *db.Database, bus *eventbus.Bus) *RevocationList {
+	return &RevocationList{DB: database, Bus: bus, revoked: map[string]time.Time{}}
+}
+
+// Revoke blocks every access token carrying id as its jti or session id until expiresAt
+func (l *RevocationList) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO revoked_tokens (id, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET expires_at = GREATEST(revoked_tokens.expires_at, EXCLUDED.expires_at)
+	`
+	_, err := l.DB.Pool.Exec(ctx, query, id, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	l.add(id, expiresAt)
+
+	// the periodic reload covers other instances if this doesn't make it
+	err = l.Bus.Publish(ctx, eventbus.RevocationChannel, revocation{Id: id, ExpiresAt: expiresAt})
+	if err != nil {
+		log.Printf("error broadcasting token revocation: %v", err)
+	}
+
+	return nil
+}
+
+func (l *RevocationList) IsRevoked(ids ...string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	now := time.Now()
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if expiresAt, ok := l.revoked[id]; ok && now.Before(expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *RevocationList) add(id string, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if current, ok := l.revoked[id]; !ok || expiresAt.After(current) {
+		l.revoked[id] = expiresAt
+	}
+}
+
+// Reload refreshes the in-memory list from postgres, dropping expired entries from both
+func (l *RevocationList) Reload(ctx context.Context) error {
+	_, err := l.DB.Pool.Exec(ctx, "DELETE FROM revoked_tokens WHERE expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	rows, err := l.DB.Pool.Query(ctx, "SELECT id, expires_at FROM revoked_tokens")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	revoked := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &expiresAt); err != nil {
+			return err
+		}
+		revoked[id] = expiresAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// keep anything revoked locally while we were reading, it may not have been visible to the query yet
+	now := time.Now()
+	l.mu.Lock()
+	for id, expiresAt := range l.revoked {
+		if _, ok := revoked[id]; !ok && now.Before(expiresAt) {
+			revoked[id] = expiresAt
+		}
+	}
+	l.revoked = revoked
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Sync keeps the in-memory list current until ctx is cancelled, applying revocations from other
+// instances as they happen and reloading from postgres every interval
+func (l *RevocationList) Sync(ctx context.Context, interval time.Duration) {
+	notifications := l.Bus.Listen(ctx, eventbus.RevocationChannel)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case notification, ok := <-notifications:
+			if !ok {
+				return
+			}
+
+			var r revocation
+			if err := json.Unmarshal(notification.Payload, &r); err != nil {
+				log.Printf("error decoding token revocation: %v", err)
+				continue
+			}
+			l.add(r.Id, r.ExpiresAt)
+		case <-ticker.C:
+			if err := l.Reload(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("error reloading revoked tokens: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+)
+
+// logSecurityEvent records something suspicious about an account both in the server log and in
+// security_events, inside tx so it only sticks if whatever reacted to it does too
+func logSecurityEvent(ctx context.Context, tx pgx.Tx, userId uint, eventType, sessionId string, device Device, details map[string]any) error {
+	log.Printf("security event %s: user %d, session %s, ip %s", eventType, userId, sessionId, device.IPAddress)
+
+	query := `
+		INSERT INTO security_events (user_id, type, session_id, ip_address, user_agent, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err := tx.Exec(ctx, query, userId, eventType, sessionId, device.IPAddress, device.UserAgent, details)
+	return err
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// Device describes where a session was started from, so users can tell their sessions apart
+type Device struct {
+	UserAgent string
+	IPAddress string
+}
+
+func DeviceFromRequest(r *http.Request) Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return Device{UserAgent: r.UserAgent(), IPAddress: ip}
+}
+
+type Session struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// insertSession starts a new session whose first refresh token is the root of its family
+func insertSession(ctx context.Context, db db.Database, sessionId string, userId uint, tokenHash string, device Device, exp time.Time) error {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		INSERT INTO sessions (id, user_id, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err = tx.Exec(ctx, query, sessionId, userId, device.UserAgent, device.IPAddress, exp)
+	if err != nil {
+		return err
+	}
+
+	query = "INSERT INTO refresh_tokens (session_id, token_hash, expires_at) VALUES ($1, $2, $3)"
+	_, err = tx.Exec(ctx, query, sessionId, tokenHash, exp)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RefreshTokens exchanges a refresh token for a new token pair on the same session. every refresh
+// token can only be used once; presenting one that was already rotated means it was stolen, so the
+// whole session is revoked
+func (s *AuthService) RefreshTokens(ctx context.Context, refreshToken string, device Device) (string, string, error) {
+	claims, err := s.ValidateToken(refreshToken)
+	// refresh tokens issued before token types existed have none
+	if err != nil || claims.SessionId == "" || (claims.Type != TokenTypeRefresh && claims.Type != "") {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var tokenId int64
+	var sessionId string
+	var userId uint
+	var rotatedAt *time.Time
+	var expired bool
+	query := `
+		SELECT rt.id, rt.session_id, s.user_id, rt.rotated_at, rt.expires_at <= CURRENT_TIMESTAMP
+		FROM refresh_tokens rt
+		JOIN sessions s ON rt.session_id = s.id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt
+	`
+	err = tx.QueryRow(ctx, query, HashToken(refreshToken)).Scan(&tokenId, &sessionId, &userId, &rotatedAt, &expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if sessionId != claims.SessionId || userId != claims.UserId || expired {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if rotatedAt != nil {
+		_, err = tx.Exec(ctx, "DELETE FROM sessions WHERE id = $1", sessionId)
+		if err != nil {
+			return "", "", err
+		}
+
+		err = logSecurityEvent(ctx, tx, userId, SecurityEventRefreshTokenReuse, sessionId, device, map[string]any{
+			"token_id":   tokenId,
+			"rotated_at": rotatedAt,
+		})
+		if err != nil {
+			return "", "", err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		return "", "", ErrRefreshTokenReused
+	}
+
+	accessToken, newRefreshToken, err := s.generateTokenPair(userId, sessionId)
+	if err != nil {
+		return "", "", err
+	}
+	exp := time.Now().Add(RefreshTokenExpiry)
+
+	_, err = tx.Exec(ctx, "UPDATE refresh_tokens SET rotated_at = CURRENT_TIMESTAMP WHERE id = $1", tokenId)
+	if err != nil {
+		return "", "", err
+	}
+
+	query = "INSERT INTO refresh_tokens (session_id, parent_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)"
+	_, err = tx.Exec(ctx, query, sessionId, tokenId, HashToken(newRefreshToken), exp)
+	if err != nil {
+		return "", "", err
+	}
+
+	query = `
+		UPDATE sessions
+		SET user_agent = $1, ip_address = $2, last_used_at = CURRENT_TIMESTAMP, expires_at = $3
+		WHERE id = $4
+	`
+	_, err = tx.Exec(ctx, query, device.UserAgent, device.IPAddress, exp, sessionId)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, newRefreshToken, nil
+}
+
+// ListSessions returns the user's unexpired sessions, most recently used first. currentSessionId
+// is marked so clients can tell which one they are
+func (s *AuthService) ListSessions(ctx context.Context, userId uint, currentSessionId string) ([]Session, error) {
+	query := `
+		SELECT id, user_agent, ip_address, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_used_at DESC
+	`
+
+	rows, err := s.DB.Pool.Query(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(&session.Id, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = session.Id == currentSessionId
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes the session so its refresh tokens stop working, and revokes its access
+// tokens so they stop working right away instead of when they expire
+func (s *AuthService) RevokeSession(ctx context.Context, userId uint, sessionId string) error {
+	query := "DELETE FROM sessions WHERE id = $1 AND user_id = $2"
+	tag, err := s.DB.Pool.Exec(ctx, query, sessionId, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+
+	return s.Revocations.Revoke(ctx, sessionId, time.Now().Add(AccessTokenExpiry))
+}
+
+func (s *AuthService) RevokeAllSessions(ctx context.Context, userId uint) error {
+	return s.RevokeOtherSessions(ctx, userId, "")
+}
+
+// RevokeOtherSessions revokes every session of the user except keepSessionId, e.g. the one that
+// just changed the password
+func (s *AuthService) RevokeOtherSessions(ctx context.Context, userId uint, keepSessionId string) error {
+	query := "DELETE FROM sessions WHERE user_id = $1 AND id::text <> $2 RETURNING id"
+	rows, err := s.DB.Pool.Query(ctx, query, userId, keepSessionId)
+	if err != nil {
+		return err
+	}
+	sessionIds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(AccessTokenExpiry)
+	for _, sessionId := range sessionIds {
+		err = s.Revocations.Revoke(ctx, sessionId, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LogoutRefreshToken ends the session a refresh token belongs to, for clients whose access token
+// has already expired. the token may have been rotated since, it only has to be genuine
+func (s *AuthService) LogoutRefreshToken(ctx context.Context, refreshToken string) error {
+	claims, err := s.ValidateToken(refreshToken)
+	if err != nil || claims.SessionId == "" || (claims.Type != TokenTypeRefresh && claims.Type != "") {
+		return ErrInvalidRefreshToken
+	}
+	return s.Logout(ctx, claims.UserId, claims.SessionId, "")
+}
+
+// Logout ends the session the access token belongs to and revokes the token itself
+func (s *AuthService) Logout(ctx context.Context, userId uint, sessionId, tokenId string) error {
+	if sessionId != "" {
+		err := s.RevokeSession(ctx, userId, sessionId)
+		if err != nil && err != ErrSessionNotFound {
+			return err
+		}
+	}
+
+	if tokenId != "" {
+		return s.Revocations.Revoke(ctx, tokenId, time.Now().Add(AccessTokenExpiry))
+	}
+	return nil
+}
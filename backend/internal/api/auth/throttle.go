@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	config "github.com/theEricHoang/lovenote/backend/internal"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+var ErrLoginLocked = errors.New("too many failed login attempts")
+
+// LoginThrottle locks out an account, or an ip, after too many failed logins in a row. lockouts
+// grow exponentially while the failures continue and everything is forgotten once the failure
+// window passes quietly. accounts are tracked by the username tried, whether or not it exists, so
+// a lockout doesn't give away which accounts do
+type LoginThrottle struct {
+	DB                 *db.Database
+	MaxAccountFailures int
+	MaxIPFailures      int
+	FailureWindow      time.Duration
+	LockoutBase        time.Duration
+	LockoutMax         time.Duration
+}
+
+func NewLoginThrottle(database *db.Database, cfg config.Config) *LoginThrottle {
+	return &LoginThrottle{
+		DB:                 database,
+		MaxAccountFailures: cfg.LoginMaxAccountFailures,
+		MaxIPFailures:      cfg.LoginMaxIPFailures,
+		FailureWindow:      cfg.LoginFailureWindow,
+		LockoutBase:        cfg.LoginLockoutBase,
+		LockoutMax:         cfg.LoginLockoutMax,
+	}
+}
+
+func accountKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns ErrLoginLocked and how long until the next attempt is allowed if either the
+// account or the ip is locked out
+func (t *LoginThrottle) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	var lockedUntil *time.Time
+	query := `
+		SELECT MAX(locked_until) FROM login_throttles
+		WHERE key = ANY($1) AND locked_until > CURRENT_TIMESTAMP
+	`
+	err := t.DB.Pool.QueryRow(ctx, query, []string{accountKey(username), ipKey(ip)}).Scan(&lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+	if lockedUntil == nil {
+		return 0, nil
+	}
+	return time.Until(*lockedUntil), ErrLoginLocked
+}
+
+// RecordFailure counts a failed login against both the account and the ip
+func (t *LoginThrottle) RecordFailure(ctx context.Context, username, ip string) error {
+	err := t.recordFailure(ctx, accountKey(username), t.MaxAccountFailures)
+	if err != nil {
+		return err
+	}
+	err = t.recordFailure(ctx, ipKey(ip), t.MaxIPFailures)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		DELETE FROM login_throttles
+		WHERE last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		AND (locked_until IS NULL OR locked_until < CURRENT_TIMESTAMP)
+	`
+	_, err = t.DB.Pool.Exec(ctx, query, t.FailureWindow.Seconds())
+	return err
+}
+
+func (t *LoginThrottle) recordFailure(ctx context.Context, key string, maxFailures int) error {
+	var failures int
+	query := `
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_throttles.last_failure_at < CURRENT_TIMESTAMP - make_interval(secs => $2) THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			last_failure_at = CURRENT_TIMESTAMP
+		RETURNING failures
+	`
+	err := t.DB.Pool.QueryRow(ctx, query, key, t.FailureWindow.Seconds()).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if failures < maxFailures {
+		return nil
+	}
+
+	_, err = t.DB.Pool.Exec(ctx,
+		"UPDATE login_throttles SET locked_until = CURRENT_TIMESTAMP + make_interval(secs => $2) WHERE key = $1",
+		key, t.lockout(failures-maxFailures).Seconds())
+	return err
+}
+
+// lockout doubles with every failure past the limit
+func (t *LoginThrottle) lockout(excess int) time.Duration {
+	lockout := t.LockoutBase
+	for range excess {
+		lockout *= 2
+		if lockout >= t.LockoutMax {
+			return t.LockoutMax
+		}
+	}
+	return min(lockout, t.LockoutMax)
+}
+
+// RecordSuccess clears the account's failures. the ip's stay, since one good password says little
+// about everything else coming from that address
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, username string) error {
+	_, err := t.DB.Pool.Exec(ctx, "DELETE FROM login_throttles WHERE key = $1", accountKey(username))
+	return err
+}
@@ -2,21 +2,28 @@ package middleware
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
 	notedao "github.com/theEricHoang/lovenote/backend/internal/api/notes/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
 )
 
 type contextKey string
 
 const UserIDKey contextKey = "userID"
+const SessionIDKey contextKey = "sessionID"
+const TokenIDKey contextKey = "tokenID"
 const RelationshipIDKey contextKey = "relationshipID"
+const RelationshipRoleKey contextKey = "relationshipRole"
 
 type AuthMiddleware struct {
 	AuthService *auth.AuthService
@@ -28,100 +35,186 @@ func NewAuthMiddleware(authService *auth.AuthService) *AuthMiddleware {
 
 func (m *AuthMiddleware) AuthenticateMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-		if tokenStr == authHeader {
-			http.Error(w, "Invalid Authorization format", http.StatusUnauthorized)
+		claims, err := m.authenticate(r)
+		if err != nil {
+			response.WriteError(w, err)
 			return
 		}
+		next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), claims)))
+	})
+}
 
-		claims, err := m.AuthService.ValidateToken(tokenStr)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
+// OptionalAuthenticateMiddleware is AuthenticateMiddleware for routes that have another way to
+// tell who's asking. requests without a valid access token go through without a user
+func (m *AuthMiddleware) OptionalAuthenticateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, err := m.authenticate(r); err == nil {
+			r = r.WithContext(withClaims(r.Context(), claims))
 		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-		userID := claims.UserId
-		expTime := claims.ExpiresAt.Time
-		if time.Now().After(expTime) {
-			http.Error(w, "Token expired", http.StatusUnauthorized)
-			return
+func (m *AuthMiddleware) authenticate(r *http.Request) (*auth.Claims, error) {
+	authHeader := r.Header.Get("Authorization")
+	// browsers can't set headers on a websocket handshake or an EventSource, so those pass the token as a query param instead
+	isStream := strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Accept") == "text/event-stream"
+	if authHeader == "" && isStream {
+		if token := r.URL.Query().Get("access_token"); token != "" {
+			authHeader = "Bearer " + token
 		}
+	}
+	if authHeader == "" {
+		return nil, response.Unauthorized("Unauthorized")
+	}
+
+	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+	if tokenStr == authHeader {
+		return nil, response.Unauthorized("Invalid Authorization format").WithCode("invalid_token")
+	}
+
+	claims, err := m.AuthService.ValidateToken(tokenStr)
+	if err != nil || claims.Type != auth.TokenTypeAccess {
+		return nil, response.Unauthorized("Invalid token").WithCode("invalid_token")
+	}
+
+	expTime := claims.ExpiresAt.Time
+	if time.Now().After(expTime) {
+		return nil, response.Unauthorized("Token expired").WithCode("token_expired")
+	}
+
+	if m.AuthService.IsRevoked(claims) {
+		return nil, response.Unauthorized("Token revoked").WithCode("token_revoked")
+	}
+	return claims, nil
+}
 
-		ctx := context.WithValue(r.Context(), UserIDKey, userID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+func withClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	ctx = context.WithValue(ctx, UserIDKey, claims.UserId)
+	ctx = context.WithValue(ctx, SessionIDKey, claims.SessionId)
+	return context.WithValue(ctx, TokenIDKey, claims.ID)
 }
 
 type PermissionsMiddleware struct {
 	RelationshipDAO *dao.RelationshipDAO
 	NoteDAO         *notedao.NoteDAO
+	UserDAO         *dao.UserDAO
 }
 
-func NewPermissionsMiddleware(relationshipDAO *dao.RelationshipDAO, noteDAO *notedao.NoteDAO) *PermissionsMiddleware {
-	return &PermissionsMiddleware{RelationshipDAO: relationshipDAO, NoteDAO: noteDAO}
+func NewPermissionsMiddleware(relationshipDAO *dao.RelationshipDAO, noteDAO *notedao.NoteDAO, userDAO *dao.UserDAO) *PermissionsMiddleware {
+	return &PermissionsMiddleware{RelationshipDAO: relationshipDAO, NoteDAO: noteDAO, UserDAO: userDAO}
+}
+
+// IsEmailVerified blocks users who haven't confirmed their email address yet
+func (m *PermissionsMiddleware) IsEmailVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(UserIDKey).(uint)
+		if !ok {
+			response.WriteError(w, response.Unauthorized("Unauthorized"))
+			return
+		}
+
+		verified, err := m.UserDAO.IsEmailVerified(r.Context(), userID)
+		if err != nil {
+			response.WriteError(w, response.Internal("Error checking if email is verified", err))
+			return
+		}
+		if !verified {
+			response.WriteError(w, response.Forbidden("Verify your email address first").WithCode("email_not_verified"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (m *PermissionsMiddleware) IsInRelationship(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := r.Context().Value(UserIDKey).(uint)
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			response.WriteError(w, response.Unauthorized("Unauthorized"))
 			return
 		}
 
 		relationshipIDParam := chi.URLParam(r, "id")
 		relationshipID64, err := strconv.ParseUint(relationshipIDParam, 10, 32)
 		if err != nil {
-			http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+			response.WriteError(w, response.BadRequest("Invalid relationship id"))
 			return
 		}
 		relationshipID := uint(relationshipID64)
 
-		userInRelationship, err := m.RelationshipDAO.UserInRelationship(r.Context(), relationshipID, userID)
-		if err != nil {
-			http.Error(w, "Error checking if user is in relationship", http.StatusInternalServerError)
+		role, err := m.RelationshipDAO.GetMemberRole(r.Context(), relationshipID, userID)
+		if err == pgx.ErrNoRows {
+			response.WriteError(w, response.Unauthorized("Unauthorized"))
 			return
 		}
-		if !userInRelationship {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if err != nil {
+			response.WriteError(w, response.Internal("Error checking if user is in relationship", err))
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), RelationshipIDKey, relationshipID)
+		ctx = context.WithValue(ctx, RelationshipRoleKey, role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireRole lets through members with at least the given role. It goes after IsInRelationship,
+// which looks the role up
+func (m *PermissionsMiddleware) RequireRole(role models.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			memberRole, ok := r.Context().Value(RelationshipRoleKey).(models.Role)
+			if !ok {
+				response.WriteError(w, response.Unauthorized("Unauthorized"))
+				return
+			}
+			if !memberRole.AtLeast(role) {
+				response.WriteError(w, response.Forbidden(fmt.Sprintf("Only a relationship's %ss can do that", role)).WithCode("insufficient_role"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func (m *PermissionsMiddleware) IsNoteOwner(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := r.Context().Value(UserIDKey).(uint)
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			response.WriteError(w, response.Unauthorized("Unauthorized"))
 			return
 		}
 
 		noteIDParam := chi.URLParam(r, "note_id")
 		noteID64, err := strconv.ParseUint(noteIDParam, 10, 32)
 		if err != nil {
-			http.Error(w, "Invalid note id", http.StatusBadRequest)
+			response.WriteError(w, response.BadRequest("Invalid note id"))
 			return
 		}
 		noteID := int(noteID64)
 
 		note, err := m.NoteDAO.GetNoteByID(r.Context(), noteID)
+		if err == pgx.ErrNoRows {
+			response.WriteError(w, response.NotFound("Note does not exist"))
+			return
+		}
 		if err != nil {
-			http.Error(w, "Note does not exist", http.StatusBadRequest)
+			response.WriteError(w, response.Internal("Error getting note", err))
+			return
+		}
+
+		// the note has to belong to the relationship in the url, which IsInRelationship already checked
+		relationshipID, ok := r.Context().Value(RelationshipIDKey).(uint)
+		if ok && note.RelationshipId != relationshipID {
+			response.WriteError(w, response.NotFound("Note does not exist"))
 			return
 		}
 
 		if userID != note.Author.Id {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			response.WriteError(w, response.Unauthorized("Unauthorized"))
 			return
 		}
 
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/ratelimit"
+)
+
+type RateLimiter struct {
+	Store ratelimit.Store
+}
+
+func NewRateLimiter(store ratelimit.Store) *RateLimiter {
+	return &RateLimiter{Store: store}
+}
+
+// Limit applies policy per user, or per client ip for anonymous requests. put it after
+// AuthenticateMiddleware on authenticated routes so it can tell users apart
+func (l *RateLimiter) Limit(policy ratelimit.Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := "ip:" + auth.DeviceFromRequest(r).IPAddress
+			if userID, ok := r.Context().Value(UserIDKey).(uint); ok {
+				key = fmt.Sprintf("user:%d", userID)
+			}
+
+			decision, err := l.Store.Take(r.Context(), policy.Name+":"+key, policy)
+			if err != nil {
+				// better to let requests through than to take the api down with the store
+				log.Printf("error checking rate limit: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int(policy.Period.Seconds())))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+			if !decision.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(decision.RetryAfter))))
+				response.WriteError(w, response.TooManyRequests("Too many requests"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -36,6 +36,7 @@ func (dao *NoteDAO) CreateNote(ctx context.Context, authorID, relationshipID uin
 		)
 		SELECT
 			n.id,
+			n.relationship_id,
 			a.id,
 			a.username,
 			a.profile_picture,
@@ -52,6 +53,7 @@ func (dao *NoteDAO) CreateNote(ctx context.Context, authorID, relationshipID uin
 	row := tx.QueryRow(ctx, query, authorID, title, content, x, y, color, relationshipID)
 	err = row.Scan(
 		&note.Id,
+		&note.RelationshipId,
 		&note.Author.Id,
 		&note.Author.Username,
 		&note.Author.ProfilePicture,
@@ -78,6 +80,7 @@ func (dao *NoteDAO) GetNoteByID(ctx context.Context, noteID int) (*models.Note,
 	query := `
 		SELECT
 			n.id,
+			n.relationship_id,
 			a.id,
 			a.username,
 			a.profile_picture,
@@ -96,6 +99,7 @@ func (dao *NoteDAO) GetNoteByID(ctx context.Context, noteID int) (*models.Note,
 	note.Author = &usermodels.User{}
 	err := dao.DB.Pool.QueryRow(ctx, query, noteID).Scan(
 		&note.Id,
+		&note.RelationshipId,
 		&note.Author.Id,
 		&note.Author.Username,
 		&note.Author.ProfilePicture,
@@ -117,6 +121,7 @@ func (dao *NoteDAO) GetNotesByRelationshipAndMonth(ctx context.Context, relation
 	query := `
 		SELECT
 			n.id,
+			n.relationship_id,
 			a.id,
 			a.username,
 			a.profile_picture,
@@ -145,6 +150,7 @@ func (dao *NoteDAO) GetNotesByRelationshipAndMonth(ctx context.Context, relation
 		note.Author = &usermodels.User{}
 		err = rows.Scan(
 			&note.Id,
+			&note.RelationshipId,
 			&note.Author.Id,
 			&note.Author.Username,
 			&note.Author.ProfilePicture,
@@ -164,13 +170,16 @@ func (dao *NoteDAO) GetNotesByRelationshipAndMonth(ctx context.Context, relation
 	return notes, nil
 }
 
-func (dao *NoteDAO) UpdateNote(ctx context.Context, noteID int, data struct {
-	Title     *string  `json:"title,omitempty"`
-	Content   *string  `json:"content,omitempty"`
-	PositionX *float32 `json:"position_x,omitempty"`
-	PositionY *float32 `json:"position_y,omitempty"`
-	Color     *string  `json:"color,omitempty"`
-}) error {
+// NoteUpdate holds the fields a PATCH changes, nil ones are left alone
+type NoteUpdate struct {
+	Title     *string
+	Content   *string
+	PositionX *float32
+	PositionY *float32
+	Color     *string
+}
+
+func (dao *NoteDAO) UpdateNote(ctx context.Context, noteID int, data NoteUpdate) error {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -181,20 +190,26 @@ func (dao *NoteDAO) UpdateNote(ctx context.Context, noteID int, data struct {
 	args := []any{}
 	argPos := 1
 
-	fields := map[string]any{
-		"title":      data.Title,
-		"content":    data.Content,
-		"position_x": data.PositionX,
-		"position_y": data.PositionY,
-		"color":      data.Color,
+	// a nil *string stored in an any isn't a nil any, so each field is checked before it's added
+	set := func(col string, val any) {
+		updates = append(updates, fmt.Sprintf("%s = $%d", col, argPos))
+		args = append(args, val)
+		argPos++
 	}
-
-	for col, val := range fields {
-		if val != nil {
-			updates = append(updates, fmt.Sprintf("%s = $%d", col, argPos))
-			args = append(args, val)
-			argPos++
-		}
+	if data.Title != nil {
+		set("title", *data.Title)
+	}
+	if data.Content != nil {
+		set("content", *data.Content)
+	}
+	if data.PositionX != nil {
+		set("position_x", *data.PositionX)
+	}
+	if data.PositionY != nil {
+		set("position_y", *data.PositionY)
+	}
+	if data.Color != nil {
+		set("color", *data.Color)
 	}
 
 	if len(updates) == 0 {
@@ -5,28 +5,36 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
 	"github.com/theEricHoang/lovenote/backend/internal/api/notes/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
+
 	usersdao "github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
 )
 
+const DefaultNoteColor = "#FFFFFF"
+
 type NoteHandler struct {
 	NoteDAO         *dao.NoteDAO
 	RelationshipDAO *usersdao.RelationshipDAO
+	Publisher       *realtime.Publisher
 }
 
-func NewNoteHandler(noteDAO *dao.NoteDAO, relationshipDAO *usersdao.RelationshipDAO) *NoteHandler {
-	return &NoteHandler{NoteDAO: noteDAO, RelationshipDAO: relationshipDAO}
+func NewNoteHandler(noteDAO *dao.NoteDAO, relationshipDAO *usersdao.RelationshipDAO, publisher *realtime.Publisher) *NoteHandler {
+	return &NoteHandler{NoteDAO: noteDAO, RelationshipDAO: relationshipDAO, Publisher: publisher}
 }
 
 func (h *NoteHandler) CreateNote(w http.ResponseWriter, r *http.Request) {
 	// get author info
 	authorID, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
@@ -34,7 +42,7 @@ func (h *NoteHandler) CreateNote(w http.ResponseWriter, r *http.Request) {
 	relationshipIDParam := chi.URLParam(r, "id")
 	relationshipID64, err := strconv.ParseUint(relationshipIDParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid relationship id"))
 		return
 	}
 	relationshipID := uint(relationshipID64)
@@ -42,46 +50,43 @@ func (h *NoteHandler) CreateNote(w http.ResponseWriter, r *http.Request) {
 	// check if author is in relationship
 	authorInRelationship, err := h.RelationshipDAO.UserInRelationship(r.Context(), relationshipID, authorID)
 	if err != nil {
-		http.Error(w, "Error verifying if user is in relationship", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error verifying if user is in relationship", err))
 		return
 	}
 	if !authorInRelationship {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	var req struct {
-		Title     string  `json:"title"`
-		Content   string  `json:"content"`
+		Title     string  `json:"title" validate:"max=100"`
+		Content   string  `json:"content" validate:"required,max=500"`
 		PositionX float32 `json:"position_x"`
 		PositionY float32 `json:"position_y"`
-		Color     string  `json:"color"`
+		Color     string  `json:"color" validate:"hexcolor"`
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err = validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
-	// input validation checks
-	if len(req.Content) > 500 {
-		http.Error(w, "Content too long. Max is 500", http.StatusBadRequest)
-		return
-	}
-	if len(req.Title) > 100 {
-		http.Error(w, "Title too long. Max is 100", http.StatusBadRequest)
-		return
+	// a blank color passes the hexcolor rule and gets the default
+	req.Color = strings.TrimSpace(req.Color)
+	if req.Color == "" {
+		req.Color = DefaultNoteColor
 	}
 
 	// create new note
 	note, err := h.NoteDAO.CreateNote(r.Context(), authorID, relationshipID, req.Title, req.Content, req.Color, req.PositionX, req.PositionY)
 	if err != nil {
-		http.Error(w, "Error inserting note into database", http.StatusInternalServerError)
-		log.Printf("%v", err)
+		response.WriteError(w, response.Internal("Error inserting note into database", err))
 		return
 	}
 
+	h.Publisher.Publish(r.Context(), realtime.NoteCreated, relationshipID, note)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(note)
@@ -90,7 +95,7 @@ func (h *NoteHandler) CreateNote(w http.ResponseWriter, r *http.Request) {
 func (h *NoteHandler) GetRelationshipNotes(w http.ResponseWriter, r *http.Request) {
 	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
 	if !ok {
-		http.Error(w, "Missing relationship ID", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
 		return
 	}
 
@@ -109,7 +114,7 @@ func (h *NoteHandler) GetRelationshipNotes(w http.ResponseWriter, r *http.Reques
 
 	notes, err := h.NoteDAO.GetNotesByRelationshipAndMonth(r.Context(), relationshipID, month, year)
 	if err != nil {
-		http.Error(w, "Error getting notes from database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error getting notes from database", err))
 		return
 	}
 
@@ -118,52 +123,78 @@ func (h *NoteHandler) GetRelationshipNotes(w http.ResponseWriter, r *http.Reques
 }
 
 func (h *NoteHandler) EditNote(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
 	noteIDParam := chi.URLParam(r, "note_id")
 	noteID64, err := strconv.ParseUint(noteIDParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid relationship id"))
 		return
 	}
 	noteID := int(noteID64)
 
 	var req struct {
-		Title     *string  `json:"title,omitempty"`
-		Content   *string  `json:"content,omitempty"`
+		Title     *string  `json:"title,omitempty" validate:"max=100"`
+		Content   *string  `json:"content,omitempty" validate:"notblank,max=500"`
 		PositionX *float32 `json:"position_x,omitempty"`
 		PositionY *float32 `json:"position_y,omitempty"`
-		Color     *string  `json:"color,omitempty"`
+		Color     *string  `json:"color,omitempty" validate:"notblank,hexcolor"`
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&req)
+	err = validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
-	err = h.NoteDAO.UpdateNote(r.Context(), noteID, req)
+	err = h.NoteDAO.UpdateNote(r.Context(), noteID, dao.NoteUpdate(req))
 	if err != nil {
-		http.Error(w, "Error updating note in database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error updating note in database", err))
 		return
 	}
 
+	note, err := h.NoteDAO.GetNoteByID(r.Context(), noteID)
+	if err != nil {
+		log.Printf("error fetching edited note %d: %v", noteID, err)
+	} else {
+		// dragging a note around only changes its position, which clients can animate differently
+		eventType := realtime.NoteEdited
+		if req.Title == nil && req.Content == nil && req.Color == nil {
+			eventType = realtime.NoteMoved
+		}
+		h.Publisher.Publish(r.Context(), eventType, relationshipID, note)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Note updated successfully"})
 }
 
 func (h *NoteHandler) DeleteNote(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
 	noteIDParam := chi.URLParam(r, "note_id")
 	noteID64, err := strconv.ParseUint(noteIDParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid relationship id"))
 		return
 	}
 	noteID := uint(noteID64)
 
 	err = h.NoteDAO.DeleteNote(r.Context(), noteID)
 	if err != nil {
-		http.Error(w, "Error deleting note", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error deleting note", err))
 		return
 	}
 
+	h.Publisher.Publish(r.Context(), realtime.NoteDeleted, relationshipID, map[string]uint{"id": noteID})
+
 	w.WriteHeader(http.StatusNoContent)
 }
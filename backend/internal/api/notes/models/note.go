@@ -8,14 +8,15 @@ import (
 )
 
 type Note struct {
-	Id        uint         `json:"id"`
-	Author    *models.User `json:"author"`
-	Title     string       `json:"title"`
-	Content   string       `json:"content"`
-	PositionX float32      `json:"position_x"`
-	PositionY float32      `json:"position_y"`
-	Color     string       `json:"color"`
-	CreatedAt *time.Time   `json:"created_at"`
+	Id             uint         `json:"id"`
+	RelationshipId uint         `json:"relationship_id"`
+	Author         *models.User `json:"author"`
+	Title          string       `json:"title"`
+	Content        string       `json:"content"`
+	PositionX      float32      `json:"position_x"`
+	PositionY      float32      `json:"position_y"`
+	Color          string       `json:"color"`
+	CreatedAt      *time.Time   `json:"created_at"`
 }
 
 func (n *Note) ToJSON(view string) ([]byte, error) {
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+)
+
+type SocketHandler struct {
+	Hub      *realtime.Hub
+	Upgrader websocket.Upgrader
+}
+
+func NewSocketHandler(hub *realtime.Hub, allowedOrigins []string) *SocketHandler {
+	return &SocketHandler{
+		Hub: hub,
+		Upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return origin == "" || slices.Contains(allowedOrigins, origin)
+			},
+		},
+	}
+}
+
+// ServeRelationship streams every note event for the relationship in the url to the client
+func (h *SocketHandler) ServeRelationship(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	// upgrader writes its own error response on failure
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sub := h.Hub.Subscribe(relationshipID)
+	defer h.Hub.Unsubscribe(sub)
+
+	// the board is read only over the socket, but we still have to read to process pongs and closes
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// hub dropped us for falling behind
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				log.Printf("error writing to websocket: %v", err)
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
+)
+
+const (
+	heartbeatPeriod = 25 * time.Second
+	replayBatchSize = 200
+	// ids come from one sequence but commit in any order, so an event numbered just below the last
+	// one a client saw may only have been committed after it disconnected. replays start this many
+	// ids further back and clients skip ids they've already applied
+	replayLookback = 100
+	// how long browsers should wait before reconnecting, in milliseconds
+	reconnectDelay = 3000
+)
+
+// StreamHandler serves the same events as SocketHandler over server-sent events, for clients
+// behind proxies that don't allow websockets
+type StreamHandler struct {
+	Hub *realtime.Hub
+	Log *realtime.EventLog
+}
+
+func NewStreamHandler(hub *realtime.Hub, eventLog *realtime.EventLog) *StreamHandler {
+	return &StreamHandler{Hub: hub, Log: eventLog}
+}
+
+func (h *StreamHandler) ServeRelationship(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response.WriteError(w, response.Internal("Streaming unsupported", nil))
+		return
+	}
+
+	// browsers send Last-Event-ID when they reconnect on their own, the query param lets clients resume manually
+	var lastID int64
+	lastIDParam := r.Header.Get("Last-Event-ID")
+	if lastIDParam == "" {
+		lastIDParam = r.URL.Query().Get("last_event_id")
+	}
+	if lastIDParam != "" {
+		id, err := strconv.ParseInt(lastIDParam, 10, 64)
+		if err != nil || id < 0 {
+			response.WriteError(w, response.BadRequest("Invalid Last-Event-ID"))
+			return
+		}
+		lastID = id
+	}
+
+	// subscribe before replaying so nothing published in between gets lost
+	sub := h.Hub.Subscribe(relationshipID)
+	defer h.Hub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // stop nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", reconnectDelay)
+
+	// events published while replaying come through the subscription as well. only those are
+	// skipped there, anything else arriving live with a lower id committed late and hasn't been sent
+	replayed := map[int64]bool{}
+	if lastID > 0 {
+		afterID := max(0, lastID-replayLookback)
+		for {
+			events, err := h.Log.Since(r.Context(), relationshipID, afterID, replayBatchSize)
+			if err != nil {
+				log.Printf("error replaying events for relationship %d: %v", relationshipID, err)
+				return
+			}
+
+			for _, event := range events {
+				if err := writeEvent(w, event); err != nil {
+					return
+				}
+				replayed[event.Id] = true
+				afterID = event.Id
+			}
+
+			if len(events) < replayBatchSize {
+				break
+			}
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				// hub dropped us for falling behind, the browser will reconnect and replay from its last id
+				return
+			}
+			if replayed[event.Id] {
+				delete(replayed, event.Id)
+				continue
+			}
+
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// anything replayed that was also published live has come through by now
+			replayed = nil
+			// comment lines keep idle connections from being closed by proxies
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event realtime.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding %s event: %v", event.Type, err)
+		return nil
+	}
+
+	if event.Id != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -0,0 +1,134 @@
+// Package response renders API errors as JSON with a stable machine readable code, so clients
+// can branch on the code instead of parsing messages
+package response
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error is an error meant for the client. Err is the underlying cause and is only logged
+type Error struct {
+	Status  int                 `json:"-"`
+	Code    string              `json:"code"`
+	Message string              `json:"message"`
+	Fields  map[string][]string `json:"fields,omitempty"`
+	Err     error               `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WithCode returns a copy of the error with a more specific code than its status gives it
+func (e *Error) WithCode(code string) *Error {
+	copied := *e
+	copied.Code = code
+	return &copied
+}
+
+// WithFields returns a copy of the error listing what's wrong with each request field
+func (e *Error) WithFields(fields map[string][]string) *Error {
+	copied := *e
+	copied.Fields = fields
+	return &copied
+}
+
+func New(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return New(http.StatusBadRequest, "bad_request", message)
+}
+
+func Unauthorized(message string) *Error {
+	return New(http.StatusUnauthorized, "unauthorized", message)
+}
+
+func Forbidden(message string) *Error {
+	return New(http.StatusForbidden, "forbidden", message)
+}
+
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, "not_found", message)
+}
+
+func Conflict(message string) *Error {
+	return New(http.StatusConflict, "conflict", message)
+}
+
+// Invalid is for requests that parsed fine but whose fields don't pass validation
+func Invalid(fields map[string][]string) *Error {
+	return New(http.StatusUnprocessableEntity, "invalid_fields", "Invalid fields").WithFields(fields)
+}
+
+func TooManyRequests(message string) *Error {
+	return New(http.StatusTooManyRequests, "rate_limited", message)
+}
+
+func BadGateway(message string) *Error {
+	return New(http.StatusBadGateway, "bad_gateway", message)
+}
+
+// Internal is for anything unexpected. err is logged rather than shown, unless it's a database
+// error that says the client asked for something missing or conflicting
+func Internal(message string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: "internal_error", Message: message, Err: err}
+}
+
+// WriteError writes err as {"error": {...}}. Anything that isn't an *Error is treated as internal
+func WriteError(w http.ResponseWriter, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal("Internal server error", err)
+	}
+
+	if apiErr.Status == http.StatusInternalServerError {
+		if mapped := fromDatabase(apiErr.Err); mapped != nil {
+			apiErr = mapped
+		} else if apiErr.Err != nil {
+			log.Printf("%s: %v", apiErr.Message, apiErr.Err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(map[string]*Error{"error": apiErr})
+}
+
+// fromDatabase turns errors that come from the client asking for a row that isn't there, or one
+// that already is, into the 404 or 409 they really are
+func fromDatabase(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NotFound("Not found")
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		return Conflict("Already exists")
+	case "23503": // foreign_key_violation, something referenced doesn't exist (anymore)
+		return NotFound("Not found")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
@@ -11,59 +12,118 @@ import (
 	"github.com/google/uuid"
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
 	notehandlers "github.com/theEricHoang/lovenote/backend/internal/api/notes/handlers"
+	realtimehandlers "github.com/theEricHoang/lovenote/backend/internal/api/realtime/handlers"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/handlers"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/imageservice"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/ratelimit"
 )
 
+// origins the frontend is served from, shared by CORS and the websocket origin check
+var AllowedOrigins = []string{"http://localhost:5173"}
+
 // define routes here
 func RegisterRoutes(
 	userHandler *handlers.UserHandler,
+	sessionHandler *handlers.SessionHandler,
+	mfaHandler *handlers.MFAHandler,
+	passkeyHandler *handlers.PasskeyHandler,
+	oauthHandler *handlers.OAuthHandler,
+	keyHandler *handlers.KeyHandler,
 	relationshipHandler *handlers.RelationshipHandler,
 	inviteHandler *handlers.InviteHandler,
+	inviteLinkHandler *handlers.InviteLinkHandler,
 	noteHandler *notehandlers.NoteHandler,
+	socketHandler *realtimehandlers.SocketHandler,
+	streamHandler *realtimehandlers.StreamHandler,
 	authMiddleware *middleware.AuthMiddleware,
 	permissionsMiddleware *middleware.PermissionsMiddleware,
+	rateLimiter *middleware.RateLimiter,
 	presigner *imageservice.Presigner,
+	// only trust X-Forwarded-For and friends when running behind our own proxy, otherwise clients could spoof their ip
+	trustProxy bool,
 ) chi.Router {
 	r := chi.NewRouter()
+	if trustProxy {
+		r.Use(chimiddleware.RealIP)
+	}
 	r.Use(chimiddleware.StripSlashes)
 	r.Use(chimiddleware.Logger)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173"}, // Allow frontend origin
+		AllowedOrigins:   AllowedOrigins, // Allow frontend origin
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true, // Allow cookies/auth headers
 		MaxAge:           300,  // Cache CORS response for 5 minutes
 	}))
 
+	// rate limit policies, per user on authenticated routes and per ip otherwise
+	authLimit := rateLimiter.Limit(ratelimit.Policy{Name: "auth", Limit: 10, Period: time.Minute})
+	emailLimit := rateLimiter.Limit(ratelimit.Policy{Name: "email", Limit: 5, Period: time.Hour})
+	searchLimit := rateLimiter.Limit(ratelimit.Policy{Name: "search", Limit: 30, Period: time.Minute})
+	inviteLimit := rateLimiter.Limit(ratelimit.Policy{Name: "invite", Limit: 20, Period: time.Hour})
+	noteLimit := rateLimiter.Limit(ratelimit.Policy{Name: "note", Limit: 30, Period: time.Minute})
+
+	r.Get("/.well-known/jwks.json", keyHandler.GetJWKSHandler)
+
+	r.Route("/api/auth/oauth", func(r chi.Router) {
+		r.Get("/providers", oauthHandler.GetProvidersHandler)
+		r.With(authLimit).Get("/{provider}", oauthHandler.BeginHandler)
+		r.Get("/{provider}/callback", oauthHandler.CallbackHandler)
+	})
+
 	// users routes
 	r.Route("/api/users", func(r chi.Router) {
-		r.Get("/", userHandler.SearchUsersHandler)
-		r.Post("/", userHandler.RegisterHandler)
-		r.Post("/login", userHandler.LoginHandler)
-		r.Post("/logout", userHandler.LogoutHandler)
+		r.With(searchLimit).Get("/", userHandler.SearchUsersHandler)
+		r.With(authLimit).Post("/", userHandler.RegisterHandler)
+		r.With(authLimit).Post("/login", userHandler.LoginHandler)
+		r.With(authLimit).Post("/login/mfa", userHandler.LoginMFAHandler)
+		r.With(authLimit).Post("/login/passkey/begin", passkeyHandler.BeginLoginHandler)
+		r.With(authLimit).Post("/login/passkey/finish", passkeyHandler.FinishLoginHandler)
+		r.With(authMiddleware.OptionalAuthenticateMiddleware).Post("/logout", userHandler.LogoutHandler)
 		r.Get("/{id}", userHandler.GetUserHandler)
 		r.Post("/refresh", userHandler.RefreshTokenHandler)
+		r.With(authLimit).Post("/verify", userHandler.VerifyEmailHandler)
+		r.With(emailLimit).Post("/password/forgot", userHandler.ForgotPasswordHandler)
+		r.With(authLimit).Post("/password/reset", userHandler.ResetPasswordHandler)
+		r.With(authLimit).Post("/email/confirm", userHandler.ConfirmEmailChangeHandler)
 		r.With(authMiddleware.AuthenticateMiddleware).Get("/me", userHandler.GetSelfHandler)
 		r.With(authMiddleware.AuthenticateMiddleware).Patch("/me", userHandler.UpdateUserHandler)
 		r.With(authMiddleware.AuthenticateMiddleware).Delete("/me", userHandler.DeleteUserHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, emailLimit).Post("/me/verify", userHandler.ResendVerificationHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, authLimit).Put("/me/password", userHandler.ChangePasswordHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, emailLimit).Post("/me/email", userHandler.ChangeEmailHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Get("/me/sessions", sessionHandler.GetSessionsHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Delete("/me/sessions", sessionHandler.RevokeAllSessionsHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Delete("/me/sessions/{session_id}", sessionHandler.RevokeSessionHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Get("/me/mfa", mfaHandler.GetMFAStatusHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Post("/me/mfa/setup", mfaHandler.SetupMFAHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, authLimit).Post("/me/mfa/enable", mfaHandler.EnableMFAHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, authLimit).Post("/me/mfa/disable", mfaHandler.DisableMFAHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, authLimit).Post("/me/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodesHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Get("/me/passkeys", passkeyHandler.GetPasskeysHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Post("/me/passkeys/begin", passkeyHandler.BeginRegistrationHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Post("/me/passkeys/finish", passkeyHandler.FinishRegistrationHandler)
+		r.With(authMiddleware.AuthenticateMiddleware).Delete("/me/passkeys/{passkey_id}", passkeyHandler.DeletePasskeyHandler)
 
 		r.With(authMiddleware.AuthenticateMiddleware).Post("/presign-put", func(w http.ResponseWriter, r *http.Request) {
 			userID, ok := r.Context().Value(middleware.UserIDKey).(uint)
 			if !ok {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				response.WriteError(w, response.Unauthorized("Unauthorized"))
 				return
 			}
 
 			var req struct {
-				Filename    string `json:"filename"`
-				ContentType string `json:"content_type"`
+				Filename    string `json:"filename" validate:"required,max=255"`
+				ContentType string `json:"content_type" validate:"required"`
 			}
 
-			err := json.NewDecoder(r.Body).Decode(&req)
-			if err != nil || req.Filename == "" || req.ContentType == "" {
-				http.Error(w, "Invalid request body", http.StatusBadRequest)
+			err := validate.Decode(w, r, &req)
+			if err != nil {
+				response.WriteError(w, err)
 				return
 			}
 
@@ -71,7 +131,7 @@ func RegisterRoutes(
 
 			url, err := presigner.PresignPut(r.Context(), key, req.ContentType)
 			if err != nil {
-				http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+				response.WriteError(w, response.Internal("Error generating presigned URL", err))
 				return
 			}
 
@@ -87,25 +147,35 @@ func RegisterRoutes(
 		r.With(authMiddleware.AuthenticateMiddleware).Get("/", relationshipHandler.GetUserRelationshipsHandler)
 		r.Get("/{id}", relationshipHandler.GetRelationshipHandler)
 		r.With(authMiddleware.AuthenticateMiddleware).Get("/{id}/members", relationshipHandler.GetRelationshipMembersHandler)
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Patch("/{id}", relationshipHandler.UpdateRelationshipHandler)
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Delete("/{id}", relationshipHandler.DeleteRelationshipHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin)).Patch("/{id}", relationshipHandler.UpdateRelationshipHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleOwner)).Delete("/{id}", relationshipHandler.DeleteRelationshipHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin)).Put("/{id}/members/{user_id}/role", relationshipHandler.ChangeMemberRoleHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Delete("/{id}/members/me", relationshipHandler.LeaveRelationshipHandler)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleOwner)).Delete("/{id}/members/{user_id}", relationshipHandler.RemoveMemberHandler)
 
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Post("/{id}/notes", noteHandler.CreateNote)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleMember), noteLimit).Post("/{id}/notes", noteHandler.CreateNote)
 		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Get("/{id}/notes", noteHandler.GetRelationshipNotes)
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.IsNoteOwner).Patch("/{id}/notes/{note_id}", noteHandler.EditNote)
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.IsNoteOwner).Delete("/{id}/notes/{note_id}", noteHandler.DeleteNote)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleMember), permissionsMiddleware.IsNoteOwner).Patch("/{id}/notes/{note_id}", noteHandler.EditNote)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleMember), permissionsMiddleware.IsNoteOwner).Delete("/{id}/notes/{note_id}", noteHandler.DeleteNote)
+
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin), permissionsMiddleware.IsEmailVerified, inviteLimit).Post("/{id}/invite", inviteHandler.InviteUser)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin)).Get("/{id}/invites", inviteHandler.GetRelationshipInvites)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin), permissionsMiddleware.IsEmailVerified, inviteLimit).Post("/{id}/invite-links", inviteLinkHandler.CreateInviteLink)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin)).Get("/{id}/invite-links", inviteLinkHandler.GetInviteLinks)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship, permissionsMiddleware.RequireRole(models.RoleAdmin)).Delete("/{id}/invite-links/{link_id}", inviteLinkHandler.RevokeInviteLink)
 
-		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Post("/{id}/invite", inviteHandler.InviteUser)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Get("/{id}/ws", socketHandler.ServeRelationship)
+		r.With(authMiddleware.AuthenticateMiddleware, permissionsMiddleware.IsInRelationship).Get("/{id}/events", streamHandler.ServeRelationship)
 
 		r.With(authMiddleware.AuthenticateMiddleware).Post("/presign-put", func(w http.ResponseWriter, r *http.Request) {
 			var req struct {
-				Filename    string `json:"filename"`
-				ContentType string `json:"content_type"`
+				Filename    string `json:"filename" validate:"required,max=255"`
+				ContentType string `json:"content_type" validate:"required"`
 			}
 
-			err := json.NewDecoder(r.Body).Decode(&req)
-			if err != nil || req.Filename == "" || req.ContentType == "" {
-				http.Error(w, "Invalid request body", http.StatusBadRequest)
+			err := validate.Decode(w, r, &req)
+			if err != nil {
+				response.WriteError(w, err)
 				return
 			}
 
@@ -113,7 +183,7 @@ func RegisterRoutes(
 
 			url, err := presigner.PresignPut(r.Context(), key, req.ContentType)
 			if err != nil {
-				http.Error(w, "Error generating presigned URL", http.StatusInternalServerError)
+				response.WriteError(w, response.Internal("Error generating presigned URL", err))
 				return
 			}
 
@@ -124,10 +194,18 @@ func RegisterRoutes(
 		})
 	})
 
+	// links are previewed before signing up, so only redeeming one needs an account
+	r.Route("/api/invite-links", func(r chi.Router) {
+		r.With(searchLimit).Get("/{token}", inviteLinkHandler.PreviewInviteLink)
+		r.With(authMiddleware.AuthenticateMiddleware, authLimit).Post("/{token}", inviteLinkHandler.RedeemInviteLink)
+	})
+
 	r.Route("/api/invites", func(r chi.Router) {
 		r.With(authMiddleware.AuthenticateMiddleware).Get("/", inviteHandler.GetInvites)
+		r.With(authMiddleware.AuthenticateMiddleware).Get("/sent", inviteHandler.GetSentInvites)
 		r.With(authMiddleware.AuthenticateMiddleware).Post("/{id}", inviteHandler.AcceptInvite)
-		r.With(authMiddleware.AuthenticateMiddleware).Delete("/{id}", inviteHandler.DeleteInvite)
+		r.With(authMiddleware.AuthenticateMiddleware).Post("/{id}/decline", inviteHandler.DeclineInvite)
+		r.With(authMiddleware.AuthenticateMiddleware).Delete("/{id}", inviteHandler.CancelInvite)
 	})
 
 	return r
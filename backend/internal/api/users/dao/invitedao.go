@@ -3,57 +3,64 @@ package dao
 import (
 	"context"
 	"errors"
+	"log"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
 )
 
 type InviteDAO struct {
-	DB *db.Database
+	DB            *db.Database
+	Relationships *RelationshipDAO
 }
 
-func NewInviteDAO(database *db.Database) *InviteDAO {
-	return &InviteDAO{DB: database}
+func NewInviteDAO(database *db.Database, relationshipDAO *RelationshipDAO) *InviteDAO {
+	return &InviteDAO{DB: database, Relationships: relationshipDAO}
 }
 
-var ErrInviteAlreadyExists = errors.New("invite already exists")
+var (
+	ErrInviteAlreadyExists = errors.New("invite already exists")
+	// the invite was already accepted, declined, cancelled or has expired
+	ErrInviteNotPending = errors.New("invite is no longer pending")
+)
 
-func (dao *InviteDAO) CreateInvite(ctx context.Context, relationshipId, inviterId, inviteeId uint, body string) (*models.Invite, error) {
-	tx, err := dao.DB.Pool.Begin(ctx)
-	if err != nil {
-		return nil, err
+// an invite can still be answered while this holds. the sweeper only catches up with expires_at
+// every so often, so it's checked here as well
+const pendingInvite = "i.status = 'pending' AND i.expires_at > NOW()"
+
+// every invite query selects these, in the order scanInvite reads them
+const inviteColumns = `
+	i.id,
+	r.id,
+	r.name,
+	COALESCE(r.picture, ''),
+	inviter.id,
+	inviter.username,
+	COALESCE(inviter.profile_picture, ''),
+	invitee.id,
+	invitee.username,
+	COALESCE(invitee.profile_picture, ''),
+	i.body,
+	CASE WHEN i.status = 'pending' AND i.expires_at <= NOW() THEN 'expired' ELSE i.status END,
+	i.created_at,
+	i.expires_at,
+	i.responded_at`
+
+const inviteJoins = `
+	JOIN relationships r ON i.relationship_id = r.id
+	JOIN users inviter ON i.inviter_id = inviter.id
+	JOIN users invitee ON i.invitee_id = invitee.id`
+
+func scanInvite(row pgx.Row) (*models.Invite, error) {
+	invite := models.Invite{
+		Relationship: &models.Relationship{},
+		Inviter:      &models.User{},
+		Invitee:      &models.User{},
 	}
-	defer tx.Rollback(ctx)
-
-	var invite models.Invite
-	invite.Relationship = &models.Relationship{}
-	invite.Inviter = &models.User{}
-	invite.Invitee = &models.User{}
-	query := `WITH inserted_invite AS (
-		INSERT INTO invites (relationship_id, inviter_id, invitee_id, body)
-		VALUES ($1, $2, $3, $4)
-		RETURNING *
-		)
-		SELECT
-			ii.id,
-			r.id,
-			r.name,
-			r.picture,
-			inviter.id,
-			inviter.username,
-			inviter.profile_picture,
-			invitee.id,
-			invitee.username,
-			invitee.profile_picture,
-			ii.body
-		FROM inserted_invite ii
-		JOIN relationships r ON ii.relationship_id = r.id
-		JOIN users inviter ON ii.inviter_id = inviter.id
-		JOIN users invitee ON ii.invitee_id = invitee.id;`
-
-	row := tx.QueryRow(ctx, query, relationshipId, inviterId, inviteeId, body)
-	err = row.Scan(
+	err := row.Scan(
 		&invite.Id,
 		&invite.Relationship.Id,
 		&invite.Relationship.Name,
@@ -65,7 +72,42 @@ func (dao *InviteDAO) CreateInvite(ctx context.Context, relationshipId, inviterI
 		&invite.Invitee.Username,
 		&invite.Invitee.ProfilePicture,
 		&invite.Body,
+		&invite.Status,
+		&invite.CreatedAt,
+		&invite.ExpiresAt,
+		&invite.RespondedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+func (dao *InviteDAO) CreateInvite(ctx context.Context, relationshipId, inviterId, inviteeId uint, body string, expiresAt time.Time) (*models.Invite, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// an earlier invite that ran out still counts as pending for the unique index until the
+	// sweeper gets to it, so it's expired here instead of blocking the new one
+	query := `UPDATE invites SET status = 'expired', responded_at = expires_at
+		WHERE relationship_id = $1 AND invitee_id = $2 AND status = 'pending' AND expires_at <= NOW()`
+	_, err = tx.Exec(ctx, query, relationshipId, inviteeId)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `WITH i AS (
+		INSERT INTO invites (relationship_id, inviter_id, invitee_id, body, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *
+		)
+		SELECT ` + inviteColumns + `
+		FROM i` + inviteJoins
+
+	invite, err := scanInvite(tx.QueryRow(ctx, query, relationshipId, inviterId, inviteeId, body, expiresAt))
 	if err != nil {
 		// 23505 is the error code for a unique constraint violation. Hard coded cuz I didnt want to add another dependency
 		// for error code constants :P
@@ -79,91 +121,128 @@ func (dao *InviteDAO) CreateInvite(ctx context.Context, relationshipId, inviterI
 	if err != nil {
 		return nil, err
 	}
-
-	return &invite, nil
+	return invite, nil
 }
 
 func (dao *InviteDAO) GetInviteById(ctx context.Context, inviteId uint) (*models.Invite, error) {
-	var invite models.Invite
-	query := "SELECT id, relationship_id, inviter_id, invitee_id, body FROM invites WHERE id = $1"
-	row := dao.DB.Pool.QueryRow(ctx, query, inviteId)
-	err := row.Scan(&invite.Id, &invite.Relationship.Id, &invite.Inviter.Id, &invite.Invitee.Id, &invite.Body)
+	query := "SELECT " + inviteColumns + " FROM invites i" + inviteJoins + " WHERE i.id = $1"
+	return scanInvite(dao.DB.Pool.QueryRow(ctx, query, inviteId))
+}
+
+// SetInviteStatus answers a pending invite with anything but accepting it, and returns
+// ErrInviteNotPending if someone else got to it first
+func (dao *InviteDAO) SetInviteStatus(ctx context.Context, inviteId uint, status models.InviteStatus) error {
+	query := "UPDATE invites i SET status = $2, responded_at = NOW() WHERE i.id = $1 AND " + pendingInvite
+
+	tag, err := dao.DB.Pool.Exec(ctx, query, inviteId, status)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &invite, nil
+	if tag.RowsAffected() == 0 {
+		return ErrInviteNotPending
+	}
+	return nil
 }
 
-func (dao *InviteDAO) DeleteInvite(ctx context.Context, inviteId uint) error {
+// AcceptInvite marks the invite accepted and adds the invitee to its relationship in one go, so a
+// full relationship leaves the invite pending. joined is false if they were already a member
+func (dao *InviteDAO) AcceptInvite(ctx context.Context, inviteId uint) (joined bool, err error) {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer tx.Rollback(ctx)
 
-	query := "DELETE FROM invites WHERE id = $1"
-	_, err = tx.Exec(ctx, query, inviteId)
+	var relationshipId, inviteeId uint
+	query := `UPDATE invites i SET status = 'accepted', responded_at = NOW()
+		WHERE i.id = $1 AND ` + pendingInvite + `
+		RETURNING i.relationship_id, i.invitee_id`
+	err = tx.QueryRow(ctx, query, inviteId).Scan(&relationshipId, &inviteeId)
+	if err == pgx.ErrNoRows {
+		return false, ErrInviteNotPending
+	}
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	joined, err = dao.Relationships.addMember(ctx, tx, inviteeId, relationshipId)
+	if err != nil {
+		return false, err
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	return joined, nil
 }
 
-func (dao *InviteDAO) GetUserInvites(ctx context.Context, userID uint, limit, offset int) ([]models.Invite, int, error) {
-	query := `
-		SELECT
-			i.id,
-			r.id,
-			r.name,
-			r.picture,
-			inviter.id,
-			inviter.username,
-			inviter.profile_picture,
-			i.body
-		FROM invites i
-		JOIN relationships r ON i.relationship_id = r.id
-		JOIN users inviter ON i.inviter_id = inviter.id
-		WHERE i.invitee_id = $1
+// ExpireInvites marks pending invites past their expiry as expired, once per interval until ctx is cancelled
+func (dao *InviteDAO) ExpireInvites(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		query := "UPDATE invites SET status = 'expired', responded_at = expires_at WHERE status = 'pending' AND expires_at <= NOW()"
+		_, err := dao.DB.Pool.Exec(ctx, query)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("error expiring invites: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listPendingInvites pages through the pending invites matching where, which compares $1
+func (dao *InviteDAO) listPendingInvites(ctx context.Context, where string, id uint, limit, offset int) ([]models.Invite, int, error) {
+	query := "SELECT " + inviteColumns + " FROM invites i" + inviteJoins + `
+		WHERE ` + where + " AND " + pendingInvite + `
 		ORDER BY i.id DESC
-		LIMIT $2 OFFSET $3
-	`
+		LIMIT $2 OFFSET $3`
 
-	rows, err := dao.DB.Pool.Query(ctx, query, userID, limit, offset)
+	rows, err := dao.DB.Pool.Query(ctx, query, id, limit, offset)
 	if err != nil {
 		return nil, 0, err
 	}
 	defer rows.Close()
 
-	var invites []models.Invite
+	invites := []models.Invite{}
 	for rows.Next() {
-		var invite models.Invite
-		err = rows.Scan(
-			&invite.Id,
-			&invite.Relationship.Id,
-			&invite.Relationship.Name,
-			&invite.Relationship.Picture,
-			&invite.Inviter.Id,
-			&invite.Inviter.Username,
-			&invite.Inviter.ProfilePicture,
-			&invite.Body,
-		)
+		invite, err := scanInvite(rows)
 		if err != nil {
 			return nil, 0, err
 		}
-		invites = append(invites, invite)
+		invites = append(invites, *invite)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
 	}
 
 	var totalCount int
-	query = `SELECT COUNT(*) FROM invites WHERE invitee_id = $1`
-	err = dao.DB.Pool.QueryRow(ctx, query, userID).Scan(&totalCount)
+	query = "SELECT COUNT(*) FROM invites i WHERE " + where + " AND " + pendingInvite
+	err = dao.DB.Pool.QueryRow(ctx, query, id).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	return invites, totalCount, nil
 }
+
+// GetUserInvites lists the pending invites a user has received
+func (dao *InviteDAO) GetUserInvites(ctx context.Context, userID uint, limit, offset int) ([]models.Invite, int, error) {
+	return dao.listPendingInvites(ctx, "i.invitee_id = $1", userID, limit, offset)
+}
+
+// GetSentInvites lists the pending invites a user has sent
+func (dao *InviteDAO) GetSentInvites(ctx context.Context, userID uint, limit, offset int) ([]models.Invite, int, error) {
+	return dao.listPendingInvites(ctx, "i.inviter_id = $1", userID, limit, offset)
+}
+
+// GetRelationshipInvites lists the pending invites into a relationship
+func (dao *InviteDAO) GetRelationshipInvites(ctx context.Context, relationshipID uint, limit, offset int) ([]models.Invite, int, error) {
+	return dao.listPendingInvites(ctx, "i.relationship_id = $1", relationshipID, limit, offset)
+}
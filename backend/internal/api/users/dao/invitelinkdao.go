@@ -0,0 +1,205 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+var (
+	// the link doesn't exist, expired, was revoked or has been used up. which one isn't given away
+	ErrInvalidInviteLink = errors.New("invalid invite link")
+	// the link is meant for a different (or not yet verified) email address
+	ErrInviteLinkEmailMismatch = errors.New("invite link is for another email")
+)
+
+// a link can be redeemed while this holds
+const activeInviteLink = "revoked_at IS NULL AND expires_at > NOW() AND (max_uses IS NULL OR uses < max_uses)"
+
+type InviteLinkDAO struct {
+	DB            *db.Database
+	Relationships *RelationshipDAO
+}
+
+func NewInviteLinkDAO(database *db.Database, relationshipDAO *RelationshipDAO) *InviteLinkDAO {
+	return &InviteLinkDAO{DB: database, Relationships: relationshipDAO}
+}
+
+func (dao *InviteLinkDAO) CreateInviteLink(ctx context.Context, relationshipId, createdBy uint, tokenHash, email string, maxUses *int, expiresAt time.Time) (*models.InviteLink, error) {
+	link := models.InviteLink{CreatedBy: &models.User{}}
+	query := `
+		WITH inserted AS (
+			INSERT INTO invite_links (relationship_id, created_by, token_hash, email, max_uses, expires_at)
+			VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6)
+			RETURNING *
+		)
+		SELECT i.id, i.relationship_id, u.id, u.username, COALESCE(u.profile_picture, ''),
+			COALESCE(i.email, ''), i.max_uses, i.uses, i.expires_at, i.created_at
+		FROM inserted i
+		JOIN users u ON u.id = i.created_by
+	`
+
+	err := dao.DB.Pool.QueryRow(ctx, query, relationshipId, createdBy, tokenHash, strings.ToLower(email), maxUses, expiresAt).Scan(
+		&link.Id,
+		&link.RelationshipId,
+		&link.CreatedBy.Id,
+		&link.CreatedBy.Username,
+		&link.CreatedBy.ProfilePicture,
+		&link.Email,
+		&link.MaxUses,
+		&link.Uses,
+		&link.ExpiresAt,
+		&link.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// GetActiveInviteLinks lists the links of a relationship that can still be redeemed
+func (dao *InviteLinkDAO) GetActiveInviteLinks(ctx context.Context, relationshipId uint) ([]models.InviteLink, error) {
+	query := `
+		SELECT l.id, l.relationship_id, u.id, u.username, COALESCE(u.profile_picture, ''),
+			COALESCE(l.email, ''), l.max_uses, l.uses, l.expires_at, l.created_at
+		FROM invite_links l
+		LEFT JOIN users u ON u.id = l.created_by
+		WHERE l.relationship_id = $1 AND ` + activeInviteLink + `
+		ORDER BY l.created_at DESC
+	`
+
+	rows, err := dao.DB.Pool.Query(ctx, query, relationshipId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.InviteLink{}
+	for rows.Next() {
+		var link models.InviteLink
+		var creatorId *uint
+		var creatorName, creatorPicture *string
+		err := rows.Scan(
+			&link.Id,
+			&link.RelationshipId,
+			&creatorId,
+			&creatorName,
+			&creatorPicture,
+			&link.Email,
+			&link.MaxUses,
+			&link.Uses,
+			&link.ExpiresAt,
+			&link.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// the creator may have deleted their account since
+		if creatorId != nil {
+			link.CreatedBy = &models.User{Id: *creatorId, Username: *creatorName, ProfilePicture: *creatorPicture}
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// RevokeInviteLink returns pgx.ErrNoRows if the relationship has no such link that's still active
+func (dao *InviteLinkDAO) RevokeInviteLink(ctx context.Context, relationshipId, linkId uint) error {
+	query := "UPDATE invite_links SET revoked_at = NOW() WHERE id = $1 AND relationship_id = $2 AND " + activeInviteLink
+
+	tag, err := dao.DB.Pool.Exec(ctx, query, linkId, relationshipId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (dao *InviteLinkDAO) PreviewInviteLink(ctx context.Context, tokenHash string) (*models.InviteLinkPreview, error) {
+	preview := models.InviteLinkPreview{Relationship: &models.Relationship{}}
+	var creatorId *uint
+	var creatorName, creatorPicture *string
+	query := `
+		SELECT r.id, r.name, r.picture, r.type,
+			u.id, u.username, COALESCE(u.profile_picture, ''),
+			(SELECT COUNT(*) FROM relationship_members WHERE relationship_id = r.id),
+			l.email IS NOT NULL, l.expires_at
+		FROM invite_links l
+		JOIN relationships r ON r.id = l.relationship_id
+		LEFT JOIN users u ON u.id = l.created_by
+		WHERE l.token_hash = $1 AND ` + activeInviteLink
+
+	err := dao.DB.Pool.QueryRow(ctx, query, tokenHash).Scan(
+		&preview.Relationship.Id,
+		&preview.Relationship.Name,
+		&preview.Relationship.Picture,
+		&preview.Relationship.Type,
+		&creatorId,
+		&creatorName,
+		&creatorPicture,
+		&preview.Members,
+		&preview.EmailRequired,
+		&preview.ExpiresAt,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, ErrInvalidInviteLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	if creatorId != nil {
+		preview.InvitedBy = &models.User{Id: *creatorId, Username: *creatorName, ProfilePicture: *creatorPicture}
+	}
+	return &preview, nil
+}
+
+// RedeemInviteLink adds the user to the link's relationship. A use is only counted when they
+// weren't a member already, which joined reports
+func (dao *InviteLinkDAO) RedeemInviteLink(ctx context.Context, tokenHash string, user *models.User) (relationshipId uint, joined bool, err error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// locked so the last use of a link can't be taken twice
+	var linkId uint
+	var email *string
+	query := "SELECT id, relationship_id, email FROM invite_links WHERE token_hash = $1 AND " + activeInviteLink + " FOR UPDATE"
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&linkId, &relationshipId, &email)
+	if err == pgx.ErrNoRows {
+		return 0, false, ErrInvalidInviteLink
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if email != nil && (!user.EmailVerified || !strings.EqualFold(*email, user.Email)) {
+		return 0, false, ErrInviteLinkEmailMismatch
+	}
+
+	joined, err = dao.Relationships.addMember(ctx, tx, user.Id, relationshipId)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if joined {
+		_, err = tx.Exec(ctx, "UPDATE invite_links SET uses = uses + 1 WHERE id = $1", linkId)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	return relationshipId, joined, nil
+}
@@ -6,53 +6,112 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
+	config "github.com/theEricHoang/lovenote/backend/internal"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
 )
 
+// LimitError is returned when joining or creating a relationship would break a membership limit
+type LimitError struct {
+	// relationship_limit, relationship_type_limit or relationship_full
+	Code  string
+	Limit int
+	Type  models.RelationshipType
+}
+
+func (e *LimitError) Error() string {
+	switch e.Code {
+	case "relationship_type_limit":
+		if e.Limit == 1 {
+			return fmt.Sprintf("You can only be in one %s relationship", e.Type)
+		}
+		return fmt.Sprintf("You can only be in %d %s relationships", e.Limit, e.Type)
+	case "relationship_full":
+		return fmt.Sprintf("This relationship already has the maximum of %d members", e.Limit)
+	}
+	return fmt.Sprintf("You can only be in %d relationships", e.Limit)
+}
+
+// ErrOutranked is returned when a member tries to change someone at or above their own level, or
+// to hand out a role as high as theirs
+var ErrOutranked = errors.New("member does not outrank the target")
+
 type RelationshipDAO struct {
-	DB *db.Database
+	DB         *db.Database
+	MaxPerUser int
+	Limits     map[models.RelationshipType]config.RelationshipLimits
+}
+
+func NewRelationshipDAO(database *db.Database, cfg config.Config) *RelationshipDAO {
+	limits := make(map[models.RelationshipType]config.RelationshipLimits, len(cfg.RelationshipLimits))
+	for relationshipType, limit := range cfg.RelationshipLimits {
+		limits[models.RelationshipType(relationshipType)] = limit
+	}
+	return &RelationshipDAO{DB: database, MaxPerUser: cfg.RelationshipMaxPerUser, Limits: limits}
+}
+
+// checkUserLimits must run after the user's row is locked, so that two joins at once can't both
+// squeeze under the limit
+func (dao *RelationshipDAO) checkUserLimits(ctx context.Context, tx pgx.Tx, userID uint, relationshipType models.RelationshipType) error {
+	var total, ofType int
+	query := `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE r.type = $2)
+		FROM relationship_members rm
+		JOIN relationships r ON r.id = rm.relationship_id
+		WHERE rm.user_id = $1
+	`
+	err := tx.QueryRow(ctx, query, userID, relationshipType).Scan(&total, &ofType)
+	if err != nil {
+		return err
+	}
+
+	if dao.MaxPerUser > 0 && total >= dao.MaxPerUser {
+		return &LimitError{Code: "relationship_limit", Limit: dao.MaxPerUser}
+	}
+	if limit := dao.Limits[relationshipType].MaxPerUser; limit > 0 && ofType >= limit {
+		return &LimitError{Code: "relationship_type_limit", Limit: limit, Type: relationshipType}
+	}
+	return nil
 }
 
-func NewRelationshipDAO(database *db.Database) *RelationshipDAO {
-	return &RelationshipDAO{DB: database}
+func lockUser(ctx context.Context, tx pgx.Tx, userID uint) error {
+	_, err := tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR NO KEY UPDATE", userID)
+	return err
 }
 
-func (dao *RelationshipDAO) CreateRelationshipAndAddUser(ctx context.Context, name, picture string, userID uint) (*models.Relationship, error) {
+func (dao *RelationshipDAO) CreateRelationshipAndAddUser(ctx context.Context, name, picture string, relationshipType models.RelationshipType, userID uint) (*models.Relationship, error) {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback(ctx)
 
-	// count to ensure user is not in more than 10 relationships
-	var count int
-	countQuery := "SELECT COUNT(*) FROM relationship_members WHERE user_id = $1"
-	err = tx.QueryRow(ctx, countQuery, userID).Scan(&count)
+	err = lockUser(ctx, tx, userID)
 	if err != nil {
 		return nil, err
 	}
-
-	if count >= 10 {
-		return nil, fmt.Errorf("user is in maximum relationships (10)")
+	err = dao.checkUserLimits(ctx, tx, userID, relationshipType)
+	if err != nil {
+		return nil, err
 	}
 
 	// create relationship
 	var relationship models.Relationship
-	query := "INSERT INTO relationships (name, picture) values ($1, $2) RETURNING id, name, picture, created_at"
+	query := "INSERT INTO relationships (name, picture, type) values ($1, $2, $3) RETURNING id, name, picture, type, created_at"
 
-	row := tx.QueryRow(ctx, query, name, picture)
-	err = row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.CreatedAt)
+	row := tx.QueryRow(ctx, query, name, picture, relationshipType)
+	err = row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.Type, &relationship.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 
-	// add user to new relationship
-	query = `INSERT INTO relationship_members (relationship_id, user_id)
-		VALUES ($1, $2)
+	// add user to new relationship, as the one in charge of it
+	query = `INSERT INTO relationship_members (relationship_id, user_id, role)
+		VALUES ($1, $2, $3)
 		ON CONFLICT DO NOTHING`
 
-	_, err = tx.Exec(ctx, query, relationship.Id, userID)
+	_, err = tx.Exec(ctx, query, relationship.Id, userID, models.RoleOwner)
 	if err != nil {
 		return nil, err
 	}
@@ -67,20 +126,23 @@ func (dao *RelationshipDAO) CreateRelationshipAndAddUser(ctx context.Context, na
 
 func (dao *RelationshipDAO) GetRelationshipById(ctx context.Context, id uint) (*models.Relationship, error) {
 	var relationship models.Relationship
-	query := "SELECT id, name, picture, created_at FROM relationships WHERE id = $1"
+	query := "SELECT id, name, picture, type, created_at FROM relationships WHERE id = $1"
 
 	row := dao.DB.Pool.QueryRow(ctx, query, id)
-	err := row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.CreatedAt)
+	err := row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.Type, &relationship.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return &relationship, nil
 }
 
-func (dao *RelationshipDAO) UpdateRelationship(ctx context.Context, relationshipId uint, data struct {
-	Name    *string `json:"name,omitempty"`
-	Picture *string `json:"picture,omitempty"`
-}) (*models.Relationship, error) {
+// RelationshipUpdate holds the fields a PATCH changes, nil ones are left alone
+type RelationshipUpdate struct {
+	Name    *string
+	Picture *string
+}
+
+func (dao *RelationshipDAO) UpdateRelationship(ctx context.Context, relationshipId uint, data RelationshipUpdate) (*models.Relationship, error) {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
 		return nil, err
@@ -99,7 +161,7 @@ func (dao *RelationshipDAO) UpdateRelationship(ctx context.Context, relationship
 
 	for col, val := range fields {
 		if val != nil {
-			updates = append(updates, fmt.Sprintf("%s = %d", col, argPos))
+			updates = append(updates, fmt.Sprintf("%s = $%d", col, argPos))
 			args = append(args, *val)
 			argPos++
 		}
@@ -109,11 +171,11 @@ func (dao *RelationshipDAO) UpdateRelationship(ctx context.Context, relationship
 		return nil, errors.New("no updates provided")
 	}
 
-	query := fmt.Sprintf("UPDATE relationships SET %s WHERE id = $%d RETURNING id, name, picture, created_at", strings.Join(updates, ", "), argPos)
+	query := fmt.Sprintf("UPDATE relationships SET %s WHERE id = $%d RETURNING id, name, picture, type, created_at", strings.Join(updates, ", "), argPos)
 	args = append(args, relationshipId)
 
 	row := tx.QueryRow(ctx, query, args...)
-	err = row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.CreatedAt)
+	err = row.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.Type, &relationship.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -160,9 +222,198 @@ func (dao *RelationshipDAO) UserInRelationship(ctx context.Context, relationship
 	return exists, nil
 }
 
+// GetMemberRole returns pgx.ErrNoRows when the user isn't a member of the relationship
+func (dao *RelationshipDAO) GetMemberRole(ctx context.Context, relationshipId, userId uint) (models.Role, error) {
+	var role models.Role
+	query := "SELECT role FROM relationship_members WHERE relationship_id = $1 AND user_id = $2"
+
+	err := dao.DB.Pool.QueryRow(ctx, query, relationshipId, userId).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// checkOutranks returns ErrOutranked unless actorId ranks above userId and every one of roles in
+// the relationship, and pgx.ErrNoRows when userId isn't a member. it reads the roles inside tx after
+// the relationship is locked, so neither can change before the caller's write
+func checkOutranks(ctx context.Context, tx pgx.Tx, relationshipId, actorId, userId uint, roles ...models.Role) error {
+	query := "SELECT role FROM relationship_members WHERE relationship_id = $1 AND user_id = $2"
+
+	var actorRole, userRole models.Role
+	err := tx.QueryRow(ctx, query, relationshipId, actorId).Scan(&actorRole)
+	if err == pgx.ErrNoRows {
+		// they were removed since the request was authorized
+		return ErrOutranked
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx, query, relationshipId, userId).Scan(&userRole)
+	if err != nil {
+		return err
+	}
+
+	for _, role := range append(roles, userRole) {
+		if !actorRole.Outranks(role) {
+			return ErrOutranked
+		}
+	}
+	return nil
+}
+
+func lockRelationship(ctx context.Context, tx pgx.Tx, relationshipId uint) error {
+	_, err := tx.Exec(ctx, "SELECT 1 FROM relationships WHERE id = $1 FOR UPDATE", relationshipId)
+	return err
+}
+
+// SetMemberRole changes a member's role on behalf of actorId, who has to outrank both the member
+// and the new role. Returns ErrOutranked if they don't, and pgx.ErrNoRows when the user isn't a member
+func (dao *RelationshipDAO) SetMemberRole(ctx context.Context, relationshipId, actorId, userId uint, role models.Role) (*models.Member, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = lockRelationship(ctx, tx, relationshipId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOutranks(ctx, tx, relationshipId, actorId, userId, role)
+	if err != nil {
+		return nil, err
+	}
+
+	var member models.Member
+	query := `
+		UPDATE relationship_members rm
+		SET role = $3
+		FROM users u
+		WHERE rm.relationship_id = $1 AND rm.user_id = $2 AND u.id = rm.user_id
+		RETURNING u.id, u.username, COALESCE(u.profile_picture, ''), rm.role, rm.joined_at
+	`
+	err = tx.QueryRow(ctx, query, relationshipId, userId, role).Scan(&member.Id, &member.Username, &member.ProfilePicture, &member.Role, &member.JoinedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// RemoveMember takes the user out of the relationship, handing ownership to the longest standing
+// of the highest ranked members left if they owned it, or deleting it if nobody is left. Returns
+// pgx.ErrNoRows when the user isn't a member
+func (dao *RelationshipDAO) RemoveMember(ctx context.Context, relationshipId, userId uint) (*models.MemberRemoval, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	removal, err := dao.removeMember(ctx, tx, relationshipId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return removal, nil
+}
+
+// RemoveMemberAs is RemoveMember on behalf of actorId, who has to outrank the member. Returns
+// ErrOutranked if they don't
+func (dao *RelationshipDAO) RemoveMemberAs(ctx context.Context, relationshipId, actorId, userId uint) (*models.MemberRemoval, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = lockRelationship(ctx, tx, relationshipId)
+	if err != nil {
+		return nil, err
+	}
+	err = checkOutranks(ctx, tx, relationshipId, actorId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	removal, err := dao.removeMember(ctx, tx, relationshipId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return removal, nil
+}
+
+// removeMember is RemoveMember inside a transaction the caller commits
+func (dao *RelationshipDAO) removeMember(ctx context.Context, tx pgx.Tx, relationshipId, userId uint) (*models.MemberRemoval, error) {
+	// lock the membership so two members leaving at once can't both skip the cleanup below
+	err := lockRelationship(ctx, tx, relationshipId)
+	if err != nil {
+		return nil, err
+	}
+
+	var role models.Role
+	query := "DELETE FROM relationship_members WHERE relationship_id = $1 AND user_id = $2 RETURNING role"
+	err = tx.QueryRow(ctx, query, relationshipId, userId).Scan(&role)
+	if err != nil {
+		return nil, err
+	}
+
+	var removal models.MemberRemoval
+	var remaining int
+	err = tx.QueryRow(ctx, "SELECT COUNT(*) FROM relationship_members WHERE relationship_id = $1", relationshipId).Scan(&remaining)
+	if err != nil {
+		return nil, err
+	}
+
+	if remaining == 0 {
+		_, err = tx.Exec(ctx, "DELETE FROM relationships WHERE id = $1", relationshipId)
+		if err != nil {
+			return nil, err
+		}
+		removal.RelationshipDeleted = true
+	} else if role == models.RoleOwner {
+		var owner models.Member
+		query = `
+			UPDATE relationship_members rm
+			SET role = 'owner'
+			FROM users u
+			WHERE rm.relationship_id = $1 AND u.id = rm.user_id AND rm.user_id = (
+				SELECT user_id FROM relationship_members
+				WHERE relationship_id = $1
+				ORDER BY CASE role WHEN 'admin' THEN 1 WHEN 'member' THEN 2 ELSE 3 END, joined_at, user_id
+				LIMIT 1
+			)
+			RETURNING u.id, u.username, COALESCE(u.profile_picture, ''), rm.role, rm.joined_at
+		`
+		err = tx.QueryRow(ctx, query, relationshipId).Scan(&owner.Id, &owner.Username, &owner.ProfilePicture, &owner.Role, &owner.JoinedAt)
+		if err != nil {
+			return nil, err
+		}
+		removal.NewOwner = &owner
+	}
+
+	return &removal, nil
+}
+
 func (dao *RelationshipDAO) IsUserOnlyMember(ctx context.Context, userID, relationshipID uint) (bool, error) {
 	var isOnly bool
-	query := `SELECT COUNT(*) = 1 FROM relationship_members WHERE relationship_id = $1 AND user_id = $2`
+	query := `SELECT COUNT(*) = 1 AND COALESCE(bool_or(user_id = $2), false) FROM relationship_members WHERE relationship_id = $1`
 
 	err := dao.DB.Pool.QueryRow(ctx, query, relationshipID, userID).Scan(&isOnly)
 	if err != nil {
@@ -171,6 +422,8 @@ func (dao *RelationshipDAO) IsUserOnlyMember(ctx context.Context, userID, relati
 	return isOnly, nil
 }
 
+// AddUserToRelationship does nothing if the user is already a member, and returns a *LimitError
+// if the relationship is full or the user is in as many relationships as they can be
 func (dao *RelationshipDAO) AddUserToRelationship(ctx context.Context, userID, relationshipID uint) error {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
@@ -178,38 +431,64 @@ func (dao *RelationshipDAO) AddUserToRelationship(ctx context.Context, userID, r
 	}
 	defer tx.Rollback(ctx)
 
-	// count to ensure user is not in more than 10 relationships
-	var count int
-	countQuery := "SELECT COUNT(*) FROM relationship_members WHERE user_id = $1"
-	err = tx.QueryRow(ctx, countQuery, userID).Scan(&count)
+	_, err = dao.addMember(ctx, tx, userID, relationshipID)
 	if err != nil {
 		return err
 	}
 
-	if count >= 10 {
-		return fmt.Errorf("user is in maximum relationships (10)")
-	}
+	return tx.Commit(ctx)
+}
 
-	query := `INSERT INTO relationship_members (relationship_id, user_id)
-		VALUES ($1, $2)
-		ON CONFLICT DO NOTHING`
+// addMember is AddUserToRelationship inside a transaction that does more. joined is false if the
+// user was already a member
+func (dao *RelationshipDAO) addMember(ctx context.Context, tx pgx.Tx, userID, relationshipID uint) (bool, error) {
+	// locking the relationship keeps two people from taking its last spot at the same time. the
+	// members are counted in a separate statement so the count sees whoever got in while we waited
+	var relationshipType models.RelationshipType
+	query := "SELECT type FROM relationships WHERE id = $1 FOR NO KEY UPDATE"
+	err := tx.QueryRow(ctx, query, relationshipID).Scan(&relationshipType)
+	if err != nil {
+		return false, err
+	}
 
-	_, err = tx.Exec(ctx, query, relationshipID, userID)
+	var members int
+	var alreadyMember bool
+	query = `SELECT COUNT(*), COALESCE(bool_or(user_id = $2), false)
+		FROM relationship_members WHERE relationship_id = $1`
+	err = tx.QueryRow(ctx, query, relationshipID, userID).Scan(&members, &alreadyMember)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if alreadyMember {
+		return false, nil
 	}
 
-	err = tx.Commit(ctx)
+	if limit := dao.Limits[relationshipType].MaxMembers; limit > 0 && members >= limit {
+		return false, &LimitError{Code: "relationship_full", Limit: limit, Type: relationshipType}
+	}
+
+	err = lockUser(ctx, tx, userID)
 	if err != nil {
-		return err
+		return false, err
+	}
+	err = dao.checkUserLimits(ctx, tx, userID, relationshipType)
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	query = `INSERT INTO relationship_members (relationship_id, user_id)
+		VALUES ($1, $2)`
+
+	_, err = tx.Exec(ctx, query, relationshipID, userID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (dao *RelationshipDAO) GetUserRelationships(ctx context.Context, userID uint) ([]models.Relationship, error) {
 	query := `
-		SELECT r.id, r.name, r.picture, r.created_at
+		SELECT r.id, r.name, r.picture, r.type, r.created_at
 		FROM relationships r
 		INNER JOIN relationship_members rm ON r.id = rm.relationship_id
 		WHERE rm.user_id = $1
@@ -224,7 +503,7 @@ func (dao *RelationshipDAO) GetUserRelationships(ctx context.Context, userID uin
 	var relationships []models.Relationship
 	for rows.Next() {
 		var relationship models.Relationship
-		if err := rows.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.CreatedAt); err != nil {
+		if err := rows.Scan(&relationship.Id, &relationship.Name, &relationship.Picture, &relationship.Type, &relationship.CreatedAt); err != nil {
 			return nil, err
 		}
 		relationships = append(relationships, relationship)
@@ -233,11 +512,11 @@ func (dao *RelationshipDAO) GetUserRelationships(ctx context.Context, userID uin
 	return relationships, nil
 }
 
-func (dao *RelationshipDAO) GetRelationshipMembers(ctx context.Context, relationshipID, requesterID uint) ([]models.User, error) {
-	var members []models.User
+func (dao *RelationshipDAO) GetRelationshipMembers(ctx context.Context, relationshipID, requesterID uint) ([]models.Member, error) {
+	var members []models.Member
 
 	query := `
-		SELECT u.id, u.username, u.profile_picture
+		SELECT u.id, u.username, u.profile_picture, rm.role, rm.joined_at
 		FROM users u
 		INNER JOIN relationship_members rm ON u.id = rm.user_id
 		WHERE rm.relationship_id = $1
@@ -255,8 +534,8 @@ func (dao *RelationshipDAO) GetRelationshipMembers(ctx context.Context, relation
 	defer rows.Close()
 
 	for rows.Next() {
-		var member models.User
-		if err := rows.Scan(&member.Id, &member.Username, &member.ProfilePicture); err != nil {
+		var member models.Member
+		if err := rows.Scan(&member.Id, &member.Username, &member.ProfilePicture, &member.Role, &member.JoinedAt); err != nil {
 			return nil, err
 		}
 		members = append(members, member)
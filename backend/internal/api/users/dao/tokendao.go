@@ -0,0 +1,187 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrEmailTaken   = errors.New("email already in use")
+)
+
+type TokenDAO struct {
+	DB *db.Database
+}
+
+func NewTokenDAO(database *db.Database) *TokenDAO {
+	return &TokenDAO{DB: database}
+}
+
+// CreateToken stores a new token for the user, invalidating any unused ones with the same purpose
+func (dao *TokenDAO) CreateToken(ctx context.Context, userId uint, purpose, email, tokenHash string, ttl time.Duration) error {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := "DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL"
+	_, err = tx.Exec(ctx, query, userId, purpose)
+	if err != nil {
+		return err
+	}
+
+	query = `INSERT INTO user_tokens (token_hash, user_id, purpose, email, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5))`
+	_, err = tx.Exec(ctx, query, tokenHash, userId, purpose, email, ttl.Seconds())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetTokenUser returns who a token belongs to without using it up, so a request can be checked
+// against the account before the token is redeemed
+func (dao *TokenDAO) GetTokenUser(ctx context.Context, tokenHash, purpose string) (uint, error) {
+	var userId uint
+	query := `SELECT user_id FROM user_tokens
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP`
+	err := dao.DB.Pool.QueryRow(ctx, query, tokenHash, purpose).Scan(&userId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+// consumeToken marks a token as used inside tx, so whatever it unlocks only happens once
+func consumeToken(ctx context.Context, tx pgx.Tx, tokenHash, purpose string) (*models.UserToken, error) {
+	var token models.UserToken
+	var email *string
+	query := `UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id, purpose, email`
+	err := tx.QueryRow(ctx, query, tokenHash, purpose).Scan(&token.UserId, &token.Purpose, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if email != nil {
+		token.Email = *email
+	}
+	return &token, nil
+}
+
+// VerifyEmail redeems an email verification token. it only counts if the user's address hasn't
+// changed since the token was sent
+func (dao *TokenDAO) VerifyEmail(ctx context.Context, tokenHash string) (uint, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	token, err := consumeToken(ctx, tx, tokenHash, models.TokenPurposeEmailVerification)
+	if err != nil {
+		return 0, err
+	}
+
+	query := "UPDATE users SET email_verified = TRUE WHERE id = $1 AND email = $2"
+	tag, err := tx.Exec(ctx, query, token.UserId, token.Email)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, ErrInvalidToken
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return token.UserId, nil
+}
+
+// ResetPassword redeems a password reset token, replacing the user's password hash. since the
+// token was emailed to them it also proves they own the address, if it hasn't changed since
+func (dao *TokenDAO) ResetPassword(ctx context.Context, tokenHash, passwordHash string) (uint, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	token, err := consumeToken(ctx, tx, tokenHash, models.TokenPurposePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	query := "UPDATE users SET password_hash = $2, email_verified = email_verified OR email = $3 WHERE id = $1"
+	_, err = tx.Exec(ctx, query, token.UserId, passwordHash, token.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	// any other outstanding reset links are useless now
+	query = "UPDATE user_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL"
+	_, err = tx.Exec(ctx, query, token.UserId, models.TokenPurposePasswordReset)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return token.UserId, nil
+}
+
+// ChangeEmail redeems an email change token, moving the user to the address it was sent to.
+// returns the old address so it can be told about the change
+func (dao *TokenDAO) ChangeEmail(ctx context.Context, tokenHash string) (uint, string, string, error) {
+	tx, err := dao.DB.Pool.Begin(ctx)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	token, err := consumeToken(ctx, tx, tokenHash, models.TokenPurposeEmailChange)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	var oldEmail string
+	query := "SELECT email FROM users WHERE id = $1 FOR UPDATE"
+	err = tx.QueryRow(ctx, query, token.UserId).Scan(&oldEmail)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	// following the link proves they own the new address
+	query = "UPDATE users SET email = $2, email_verified = TRUE WHERE id = $1"
+	_, err = tx.Exec(ctx, query, token.UserId, token.Email)
+	if err != nil {
+		return 0, "", "", uniqueUserError(err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	return token.UserId, oldEmail, token.Email, nil
+}
@@ -2,19 +2,40 @@ package dao
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
 	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
 )
 
+var ErrUsernameTaken = errors.New("username already in use")
+
+// uniqueUserError turns a unique violation on users into ErrUsernameTaken or ErrEmailTaken
+func uniqueUserError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return err
+	}
+	switch {
+	case strings.Contains(pgErr.ConstraintName, "username"):
+		return ErrUsernameTaken
+	case strings.Contains(pgErr.ConstraintName, "email"):
+		return ErrEmailTaken
+	}
+	return err
+}
+
 type UserDAO struct {
-	DB *db.Database
+	DB            *db.Database
+	Relationships *RelationshipDAO
 }
 
-func NewUserDAO(database *db.Database) *UserDAO {
-	return &UserDAO{DB: database}
+func NewUserDAO(database *db.Database, relationshipDAO *RelationshipDAO) *UserDAO {
+	return &UserDAO{DB: database, Relationships: relationshipDAO}
 }
 
 func (dao *UserDAO) CreateUser(ctx context.Context, username, email, profilePicture, passwordHash string) (*models.User, error) {
@@ -29,7 +50,7 @@ func (dao *UserDAO) CreateUser(ctx context.Context, username, email, profilePict
 		RETURNING id, username, email, profile_picture, password_hash`
 	err = tx.QueryRow(ctx, query, username, email, profilePicture, passwordHash).Scan(&user.Id, &user.Username, &user.Email, &user.ProfilePicture, &user.PasswordHash)
 	if err != nil {
-		return nil, err
+		return nil, uniqueUserError(err)
 	}
 	err = tx.Commit(ctx)
 	if err != nil {
@@ -41,8 +62,18 @@ func (dao *UserDAO) CreateUser(ctx context.Context, username, email, profilePict
 
 func (dao *UserDAO) GetUserByUsername(ctx context.Context, username string) (*models.User, error) {
 	var user models.User
-	query := "SELECT id, username, email, profile_picture, bio, password_hash FROM users WHERE username = $1"
-	err := dao.DB.Pool.QueryRow(ctx, query, username).Scan(&user.Id, &user.Username, &user.Email, &user.ProfilePicture, &user.Bio, &user.PasswordHash)
+	query := "SELECT id, username, email, email_verified, profile_picture, bio, password_hash FROM users WHERE username = $1"
+	err := dao.DB.Pool.QueryRow(ctx, query, username).Scan(&user.Id, &user.Username, &user.Email, &user.EmailVerified, &user.ProfilePicture, &user.Bio, &user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (dao *UserDAO) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	var user models.User
+	query := "SELECT id, username, email, email_verified, profile_picture, bio, password_hash FROM users WHERE email = $1"
+	err := dao.DB.Pool.QueryRow(ctx, query, email).Scan(&user.Id, &user.Username, &user.Email, &user.EmailVerified, &user.ProfilePicture, &user.Bio, &user.PasswordHash)
 	if err != nil {
 		return nil, err
 	}
@@ -51,20 +82,46 @@ func (dao *UserDAO) GetUserByUsername(ctx context.Context, username string) (*mo
 
 func (dao *UserDAO) GetUserById(ctx context.Context, id uint) (*models.User, error) {
 	var user models.User
-	query := "SELECT id, username, email, profile_picture, bio, password_hash FROM users WHERE id = $1"
+	query := "SELECT id, username, email, email_verified, profile_picture, bio, password_hash FROM users WHERE id = $1"
 	row := dao.DB.Pool.QueryRow(ctx, query, id)
-	err := row.Scan(&user.Id, &user.Username, &user.Email, &user.ProfilePicture, &user.Bio, &user.PasswordHash)
+	err := row.Scan(&user.Id, &user.Username, &user.Email, &user.EmailVerified, &user.ProfilePicture, &user.Bio, &user.PasswordHash)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (dao *UserDAO) UpdateUser(ctx context.Context, userId uint, data struct {
-	Username       *string `json:"username,omitempty"`
-	ProfilePicture *string `json:"profile_picture,omitempty"`
-	Bio            *string `json:"bio,omitempty"`
-}) error {
+func (dao *UserDAO) IsEmailVerified(ctx context.Context, id uint) (bool, error) {
+	var verified bool
+	query := "SELECT email_verified FROM users WHERE id = $1"
+	err := dao.DB.Pool.QueryRow(ctx, query, id).Scan(&verified)
+	if err != nil {
+		return false, err
+	}
+	return verified, nil
+}
+
+func (dao *UserDAO) UpdatePassword(ctx context.Context, id uint, passwordHash string) error {
+	query := "UPDATE users SET password_hash = $2 WHERE id = $1"
+	_, err := dao.DB.Pool.Exec(ctx, query, id, passwordHash)
+	return err
+}
+
+// ReplacePasswordHash swaps in a new hash of the same password, unless the password was changed in the meantime
+func (dao *UserDAO) ReplacePasswordHash(ctx context.Context, id uint, oldHash, newHash string) error {
+	query := "UPDATE users SET password_hash = $3 WHERE id = $1 AND password_hash = $2"
+	_, err := dao.DB.Pool.Exec(ctx, query, id, oldHash, newHash)
+	return err
+}
+
+// UserUpdate holds the profile fields a PATCH changes, nil ones are left alone
+type UserUpdate struct {
+	Username       *string
+	ProfilePicture *string
+	Bio            *string
+}
+
+func (dao *UserDAO) UpdateUser(ctx context.Context, userId uint, data UserUpdate) error {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -98,7 +155,7 @@ func (dao *UserDAO) UpdateUser(ctx context.Context, userId uint, data struct {
 
 	_, err = tx.Exec(ctx, query, args...)
 	if err != nil {
-		return err
+		return uniqueUserError(err)
 	}
 
 	err = tx.Commit(ctx)
@@ -109,25 +166,47 @@ func (dao *UserDAO) UpdateUser(ctx context.Context, userId uint, data struct {
 	return nil
 }
 
-func (dao *UserDAO) DeleteUser(ctx context.Context, userId uint) error {
+// DeleteUser takes the user out of each of their relationships the way leaving would, so owned ones
+// get a new owner and empty ones are deleted, then deletes them. returns what changed in each
+// relationship, by relationship id
+func (dao *UserDAO) DeleteUser(ctx context.Context, userId uint) (map[uint]*models.MemberRemoval, error) {
 	tx, err := dao.DB.Pool.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback(ctx)
 
+	// in id order, so this locks relationships in the same order as any other account deletion
+	rows, err := tx.Query(ctx, "SELECT relationship_id FROM relationship_members WHERE user_id = $1 ORDER BY relationship_id", userId)
+	if err != nil {
+		return nil, err
+	}
+	relationshipIds, err := pgx.CollectRows(rows, pgx.RowTo[uint])
+	if err != nil {
+		return nil, err
+	}
+
+	removals := map[uint]*models.MemberRemoval{}
+	for _, relationshipId := range relationshipIds {
+		removal, err := dao.Relationships.removeMember(ctx, tx, relationshipId, userId)
+		if err != nil {
+			return nil, err
+		}
+		removals[relationshipId] = removal
+	}
+
 	query := "DELETE FROM users WHERE id = $1"
 	_, err = tx.Exec(ctx, query, userId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = tx.Commit(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return removals, nil
 }
 
 func (dao *UserDAO) SearchUsersByName(ctx context.Context, search string, limit, offset int) ([]models.User, int, error) {
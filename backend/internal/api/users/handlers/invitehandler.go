@@ -5,68 +5,95 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
 )
 
 type InviteHandler struct {
 	InviteDAO       *dao.InviteDAO
 	RelationshipDAO *dao.RelationshipDAO
+	Publisher       *realtime.Publisher
+	// how long an invite stays pending without an answer
+	InviteExpiry time.Duration
 }
 
-func NewInviteHandler(inviteDAO *dao.InviteDAO, relationshipDAO *dao.RelationshipDAO) *InviteHandler {
-	return &InviteHandler{InviteDAO: inviteDAO, RelationshipDAO: relationshipDAO}
+func NewInviteHandler(inviteDAO *dao.InviteDAO, relationshipDAO *dao.RelationshipDAO, publisher *realtime.Publisher, inviteExpiry time.Duration) *InviteHandler {
+	return &InviteHandler{InviteDAO: inviteDAO, RelationshipDAO: relationshipDAO, Publisher: publisher, InviteExpiry: inviteExpiry}
+}
+
+func inviteNotPending(invite *models.Invite) *response.Error {
+	return response.Conflict(fmt.Sprintf("This invite is no longer pending, it has been %s", invite.Status)).WithCode("invite_not_pending")
+}
+
+// getInvite loads the invite named in the url
+func (h *InviteHandler) getInvite(r *http.Request) (*models.Invite, error) {
+	inviteId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		return nil, response.BadRequest("Invalid invite id")
+	}
+
+	invite, err := h.InviteDAO.GetInviteById(r.Context(), uint(inviteId))
+	if err == pgx.ErrNoRows {
+		return nil, response.NotFound("Invite does not exist")
+	}
+	if err != nil {
+		return nil, response.Internal("Error getting invite from database", err)
+	}
+	return invite, nil
 }
 
 func (h *InviteHandler) InviteUser(w http.ResponseWriter, r *http.Request) {
 	// get inviter info
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	// get relationship info
 	relationshipId, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
 	if !ok {
-		http.Error(w, "Missing relationship ID", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
 		return
 	}
 
 	var req struct {
-		InviteeId uint   `json:"invitee_id"`
-		Body      string `json:"body"`
+		InviteeId uint   `json:"invitee_id" validate:"required"`
+		Body      string `json:"body" validate:"max=255"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	if len(req.Body) > 255 {
-		http.Error(w, "Body too long. Max is 255", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
 	// create new invite
-	invite, err := h.InviteDAO.CreateInvite(r.Context(), relationshipId, userId, req.InviteeId, req.Body)
+	invite, err := h.InviteDAO.CreateInvite(r.Context(), relationshipId, userId, req.InviteeId, req.Body, time.Now().Add(h.InviteExpiry))
 	if err != nil {
 		if err == dao.ErrInviteAlreadyExists {
-			http.Error(w, "Invite already exists", http.StatusConflict)
+			response.WriteError(w, response.Conflict("This user already has a pending invite to this relationship"))
 			return
 		}
-		http.Error(w, "Error inserting invite into database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error inserting invite into database", err))
 		return
 	}
 
+	h.Publisher.Publish(r.Context(), realtime.InviteCreated, relationshipId, invite)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(invite)
 	if err != nil {
-		http.Error(w, "Error encoding new invite to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding new invite to JSON", err))
 		return
 	}
 }
@@ -75,126 +102,202 @@ func (h *InviteHandler) AcceptInvite(w http.ResponseWriter, r *http.Request) {
 	// get current user
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
-	// get invite id from url
-	inviteIdParam := chi.URLParam(r, "id")
-	inviteId64, err := strconv.ParseUint(inviteIdParam, 10, 32)
+	invite, err := h.getInvite(r)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
-	inviteId := uint(inviteId64)
-
-	// confirm if current user is invitee
-	invite, err := h.InviteDAO.GetInviteById(r.Context(), inviteId)
-	if err != nil {
-		http.Error(w, "Error checking if user is invitee", http.StatusInternalServerError)
+	if userId != invite.Invitee.Id {
+		response.WriteError(w, response.Forbidden("Only the invitee can accept an invite"))
 		return
 	}
-	if userId != invite.Invitee.Id {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if invite.Status != models.InvitePending {
+		response.WriteError(w, inviteNotPending(invite))
 		return
 	}
 
 	// add them to the relationship
-	err = h.RelationshipDAO.AddUserToRelationship(r.Context(), userId, invite.Relationship.Id)
-	if err != nil {
-		http.Error(w, "Error adding user to relationship", http.StatusInternalServerError)
+	joined, err := h.InviteDAO.AcceptInvite(r.Context(), invite.Id)
+	if err == dao.ErrInviteNotPending {
+		response.WriteError(w, response.Conflict("This invite is no longer pending").WithCode("invite_not_pending"))
+		return
+	}
+	if limitErr := limitError(err); limitErr != nil {
+		response.WriteError(w, limitErr)
 		return
 	}
-
-	// delete invite
-	err = h.InviteDAO.DeleteInvite(r.Context(), inviteId)
 	if err != nil {
-		http.Error(w, "Error deleting invite", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error adding user to relationship", err))
 		return
 	}
 
+	h.Publisher.Publish(r.Context(), realtime.InviteClosed, invite.Relationship.Id, map[string]any{"id": invite.Id, "status": models.InviteAccepted})
+	if joined {
+		h.Publisher.Publish(r.Context(), realtime.MemberJoined, invite.Relationship.Id, map[string]uint{"user_id": userId})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	response := map[string]string{
+	res := map[string]string{
 		"message":         "User added to relationship",
 		"relationship_id": strconv.FormatUint(uint64(invite.Relationship.Id), 10),
 	}
-	err = json.NewEncoder(w).Encode(response)
+	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
-		http.Error(w, "error writing response to json", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("error writing response to json", err))
 		return
 	}
 }
 
-func (h *InviteHandler) DeleteInvite(w http.ResponseWriter, r *http.Request) {
-	// get current user
+// DeclineInvite is the invitee turning an invite down
+func (h *InviteHandler) DeclineInvite(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
-	// get invite id from url
-	inviteIdParam := chi.URLParam(r, "id")
-	inviteId64, err := strconv.ParseUint(inviteIdParam, 10, 32)
+	invite, err := h.getInvite(r)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, err)
+		return
+	}
+	if userId != invite.Invitee.Id {
+		response.WriteError(w, response.Forbidden("Only the invitee can decline an invite"))
 		return
 	}
-	inviteId := uint(inviteId64)
 
-	// confirm if current user is invitee or invitee
-	invite, err := h.InviteDAO.GetInviteById(r.Context(), inviteId)
+	h.closeInvite(w, r, invite, models.InviteDeclined)
+}
+
+// CancelInvite takes back an invite. the inviter can always do this, and so can admins of the
+// relationship, since they're the ones who can see its pending invites
+func (h *InviteHandler) CancelInvite(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	invite, err := h.getInvite(r)
 	if err != nil {
-		http.Error(w, "Error checking if user is invitee", http.StatusInternalServerError)
+		response.WriteError(w, err)
 		return
 	}
-	if userId != invite.Invitee.Id || userId != invite.Inviter.Id {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if userId != invite.Inviter.Id {
+		role, err := h.RelationshipDAO.GetMemberRole(r.Context(), invite.Relationship.Id, userId)
+		if err != nil && err != pgx.ErrNoRows {
+			response.WriteError(w, response.Internal("Error getting member role", err))
+			return
+		}
+		if err == pgx.ErrNoRows || !role.AtLeast(models.RoleAdmin) {
+			response.WriteError(w, response.Forbidden("Only the inviter or an admin can cancel an invite"))
+			return
+		}
+	}
+
+	h.closeInvite(w, r, invite, models.InviteCancelled)
+}
+
+func (h *InviteHandler) closeInvite(w http.ResponseWriter, r *http.Request, invite *models.Invite, status models.InviteStatus) {
+	if invite.Status != models.InvitePending {
+		response.WriteError(w, inviteNotPending(invite))
 		return
 	}
 
-	// delete invite
-	err = h.InviteDAO.DeleteInvite(r.Context(), inviteId)
+	err := h.InviteDAO.SetInviteStatus(r.Context(), invite.Id, status)
+	if err == dao.ErrInviteNotPending {
+		response.WriteError(w, response.Conflict("This invite is no longer pending").WithCode("invite_not_pending"))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error deleting invite", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error updating invite", err))
 		return
 	}
 
+	h.Publisher.Publish(r.Context(), realtime.InviteClosed, invite.Relationship.Id, map[string]any{"id": invite.Id, "status": status})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// GetInvites lists the pending invites the current user has received
 func (h *InviteHandler) GetInvites(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
-	// Default values for pagination
-	limit := 10
-	page := 1
+	limit, page := pageParams(r)
+	invites, inviteCount, err := h.InviteDAO.GetUserInvites(r.Context(), userId, limit, (page-1)*limit)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error fetching invites from database", err))
+		return
+	}
+	writeInvitePage(w, r, invites, inviteCount, limit, page)
+}
 
-	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
-		limit = l
+// GetSentInvites lists the pending invites the current user has sent
+func (h *InviteHandler) GetSentInvites(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
 	}
-	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
-		page = p
+
+	limit, page := pageParams(r)
+	invites, inviteCount, err := h.InviteDAO.GetSentInvites(r.Context(), userId, limit, (page-1)*limit)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error fetching invites from database", err))
+		return
 	}
+	writeInvitePage(w, r, invites, inviteCount, limit, page)
+}
 
-	offset := (page - 1) * limit
+// GetRelationshipInvites lists the pending invites into a relationship, whoever sent them
+func (h *InviteHandler) GetRelationshipInvites(w http.ResponseWriter, r *http.Request) {
+	relationshipId, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
 
-	invites, inviteCount, err := h.InviteDAO.GetUserInvites(r.Context(), userId, limit, offset)
+	limit, page := pageParams(r)
+	invites, inviteCount, err := h.InviteDAO.GetRelationshipInvites(r.Context(), relationshipId, limit, (page-1)*limit)
 	if err != nil {
-		http.Error(w, "Error fetching invites from database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error fetching invites from database", err))
 		return
 	}
+	writeInvitePage(w, r, invites, inviteCount, limit, page)
+}
+
+// the most invites a single page can hold
+const maxPageSize = 50
+
+func pageParams(r *http.Request) (limit, page int) {
+	// Default values for pagination
+	limit = 10
+	page = 1
+
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxPageSize)
+	}
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+	return limit, page
+}
 
+func writeInvitePage(w http.ResponseWriter, r *http.Request, invites []models.Invite, inviteCount, limit, page int) {
 	baseURL := fmt.Sprintf("http://%s%s", r.Host, r.URL.Path)
 	queryParams := fmt.Sprintf("limit=%d", limit)
 
 	var nextLink, prevLink *string
-	if offset+limit < inviteCount {
+	if page*limit < inviteCount {
 		next := fmt.Sprintf("%s?%s&page=%d", baseURL, queryParams, page+1)
 		nextLink = &next
 	}
@@ -203,7 +306,7 @@ func (h *InviteHandler) GetInvites(w http.ResponseWriter, r *http.Request) {
 		prevLink = &prev
 	}
 
-	response := map[string]any{
+	res := map[string]any{
 		"count":   inviteCount,
 		"next":    nextLink,
 		"prev":    prevLink,
@@ -211,5 +314,5 @@ func (h *InviteHandler) GetInvites(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(res)
 }
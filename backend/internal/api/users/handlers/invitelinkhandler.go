@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
+)
+
+const DefaultInviteLinkExpiry = 7 * 24 * time.Hour
+
+type InviteLinkHandler struct {
+	InviteLinkDAO *dao.InviteLinkDAO
+	UserDAO       *dao.UserDAO
+	Publisher     *realtime.Publisher
+	// the frontend, which links point at
+	AppURL string
+}
+
+func NewInviteLinkHandler(inviteLinkDAO *dao.InviteLinkDAO, userDAO *dao.UserDAO, publisher *realtime.Publisher, appURL string) *InviteLinkHandler {
+	return &InviteLinkHandler{InviteLinkDAO: inviteLinkDAO, UserDAO: userDAO, Publisher: publisher, AppURL: appURL}
+}
+
+var errInvalidInviteLink = response.NotFound("This invite link is invalid or has expired").WithCode("invalid_invite_link")
+
+func (h *InviteLinkHandler) CreateInviteLink(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	var req struct {
+		// defaults to a week, and can be up to 30 days
+		ExpiresInHours *int `json:"expires_in_hours,omitempty" validate:"min=1,max=720"`
+		// defaults to unlimited until the link expires
+		MaxUses *int    `json:"max_uses,omitempty" validate:"min=1,max=100"`
+		Email   *string `json:"email,omitempty" validate:"email"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	expiry := DefaultInviteLinkExpiry
+	if req.ExpiresInHours != nil {
+		expiry = time.Duration(*req.ExpiresInHours) * time.Hour
+	}
+	email := ""
+	if req.Email != nil {
+		email = *req.Email
+	}
+
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		response.WriteError(w, response.Internal("Error generating token", err))
+		return
+	}
+
+	link, err := h.InviteLinkDAO.CreateInviteLink(r.Context(), relationshipID, userId, tokenHash, email, req.MaxUses, time.Now().Add(expiry))
+	if err != nil {
+		response.WriteError(w, response.Internal("Error saving invite link", err))
+		return
+	}
+
+	// the token can't be recovered from what's stored, so this is the only time it's shown
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"link":  link,
+		"token": token,
+		"url":   h.AppURL + "/invite/" + token,
+	})
+}
+
+func (h *InviteLinkHandler) GetInviteLinks(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	links, err := h.InviteLinkDAO.GetActiveInviteLinks(r.Context(), relationshipID)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting invite links from database", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
+
+func (h *InviteLinkHandler) RevokeInviteLink(w http.ResponseWriter, r *http.Request) {
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	linkId64, err := strconv.ParseUint(chi.URLParam(r, "link_id"), 10, 32)
+	if err != nil {
+		response.WriteError(w, response.BadRequest("Invalid invite link id"))
+		return
+	}
+
+	err = h.InviteLinkDAO.RevokeInviteLink(r.Context(), relationshipID, uint(linkId64))
+	if err == pgx.ErrNoRows {
+		response.WriteError(w, response.NotFound("Invite link does not exist"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking invite link", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreviewInviteLink shows what a link leads to without needing an account, so the frontend can
+// say who's inviting someone before they sign up
+func (h *InviteLinkHandler) PreviewInviteLink(w http.ResponseWriter, r *http.Request) {
+	preview, err := h.InviteLinkDAO.PreviewInviteLink(r.Context(), auth.HashToken(chi.URLParam(r, "token")))
+	if err == dao.ErrInvalidInviteLink {
+		response.WriteError(w, errInvalidInviteLink)
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting invite link", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
+
+func (h *InviteLinkHandler) RedeemInviteLink(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting user from database", err))
+		return
+	}
+
+	relationshipID, joined, err := h.InviteLinkDAO.RedeemInviteLink(r.Context(), auth.HashToken(chi.URLParam(r, "token")), user)
+	if err == dao.ErrInvalidInviteLink {
+		response.WriteError(w, errInvalidInviteLink)
+		return
+	}
+	if err == dao.ErrInviteLinkEmailMismatch {
+		response.WriteError(w, response.Forbidden("This invite link is for another email address. Verify that address on your account to use it").WithCode("invite_link_email_mismatch"))
+		return
+	}
+	if limitErr := limitError(err); limitErr != nil {
+		response.WriteError(w, limitErr)
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error adding user to relationship", err))
+		return
+	}
+
+	status := http.StatusOK
+	if joined {
+		h.Publisher.Publish(r.Context(), realtime.MemberJoined, relationshipID, map[string]uint{"user_id": userId})
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"relationship_id": relationshipID,
+		"joined":          joined,
+	})
+}
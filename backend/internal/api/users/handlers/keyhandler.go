@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+)
+
+type KeyHandler struct {
+	AuthService *auth.AuthService
+}
+
+func NewKeyHandler(authService *auth.AuthService) *KeyHandler {
+	return &KeyHandler{AuthService: authService}
+}
+
+// GetJWKSHandler publishes our token verification keys for other services
+func (h *KeyHandler) GetJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.AuthService.Keys.JWKS())
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/totp"
+)
+
+// shown next to the account name in authenticator apps
+const MFAIssuer = "lovenote"
+
+type MFAHandler struct {
+	UserDAO     *dao.UserDAO
+	AuthService *auth.AuthService
+}
+
+func NewMFAHandler(userDAO *dao.UserDAO, authService *auth.AuthService) *MFAHandler {
+	return &MFAHandler{UserDAO: userDAO, AuthService: authService}
+}
+
+func (h *MFAHandler) GetMFAStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	status, err := h.AuthService.GetMFAStatus(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting two-factor status", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetupMFAHandler generates a new secret for the user to add to their authenticator app
+func (h *MFAHandler) SetupMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.NotFound("User does not exist"))
+		return
+	}
+
+	secret, err := h.AuthService.BeginMFASetup(r.Context(), userId)
+	if err == auth.ErrMFAAlreadyEnabled {
+		response.WriteError(w, response.Conflict("Two-factor authentication is already enabled").WithCode("mfa_already_enabled"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error setting up two-factor authentication", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(MFAIssuer, user.Username, secret),
+	})
+}
+
+func (h *MFAHandler) EnableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	codes, err := h.AuthService.EnableMFA(r.Context(), userId, req.Code)
+	if err == auth.ErrMFANotSetUp {
+		response.WriteError(w, response.BadRequest("Set up two-factor authentication first").WithCode("mfa_not_set_up"))
+		return
+	}
+	if err == auth.ErrMFAAlreadyEnabled {
+		response.WriteError(w, response.Conflict("Two-factor authentication is already enabled").WithCode("mfa_already_enabled"))
+		return
+	}
+	if err == auth.ErrInvalidMFACode {
+		response.WriteError(w, response.BadRequest("Invalid two-factor code").WithCode("mfa_code_invalid"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error enabling two-factor authentication", err))
+		return
+	}
+
+	// this is the only time the recovery codes are ever shown
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableMFAHandler needs both the password and a code, so a stolen session alone can't turn it off
+func (h *MFAHandler) DisableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	var req struct {
+		Password string `json:"password" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.NotFound("User does not exist"))
+		return
+	}
+
+	err = h.AuthService.CheckPassword(user.PasswordHash, req.Password)
+	if err != nil {
+		response.WriteError(w, response.Forbidden("Password is incorrect").WithCode("invalid_credentials"))
+		return
+	}
+
+	if !h.verifyCode(w, r, userId, req.Code) {
+		return
+	}
+
+	err = h.AuthService.DisableMFA(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error disabling two-factor authentication", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *MFAHandler) RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	if !h.verifyCode(w, r, userId, req.Code) {
+		return
+	}
+
+	codes, err := h.AuthService.RegenerateRecoveryCodes(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error generating recovery codes", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// verifyCode writes the error response itself when the code isn't accepted
+func (h *MFAHandler) verifyCode(w http.ResponseWriter, r *http.Request, userId uint, code string) bool {
+	err := h.AuthService.VerifyMFA(r.Context(), userId, code)
+	if err == auth.ErrMFANotSetUp {
+		response.WriteError(w, response.BadRequest("Two-factor authentication is not enabled").WithCode("mfa_not_enabled"))
+		return false
+	}
+	if err == auth.ErrInvalidMFACode {
+		response.WriteError(w, response.Forbidden("Invalid two-factor code").WithCode("mfa_code_invalid"))
+		return false
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error verifying two-factor code", err))
+		return false
+	}
+	return true
+}
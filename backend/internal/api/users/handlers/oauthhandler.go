@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+)
+
+const oauthStateCookie = "oauth_state"
+
+type OAuthHandler struct {
+	OAuthService *auth.OAuthService
+	AuthService  *auth.AuthService
+	// the frontend, which logins end up back at
+	AppURL string
+}
+
+func NewOAuthHandler(oauthService *auth.OAuthService, authService *auth.AuthService, appURL string) *OAuthHandler {
+	return &OAuthHandler{OAuthService: oauthService, AuthService: authService, AppURL: appURL}
+}
+
+func (h *OAuthHandler) GetProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.OAuthService.ProviderNames())
+}
+
+// BeginHandler sends the browser off to the provider to sign in
+func (h *OAuthHandler) BeginHandler(w http.ResponseWriter, r *http.Request) {
+	authURL, state, err := h.OAuthService.Begin(r.Context(), chi.URLParam(r, "provider"))
+	if err == auth.ErrUnknownOAuthProvider {
+		response.WriteError(w, response.NotFound("Unknown login provider"))
+		return
+	}
+	if err != nil {
+		log.Printf("error starting oauth login: %v", err)
+		response.WriteError(w, response.BadGateway("Error starting login"))
+		return
+	}
+
+	// the callback has to come back to the same browser that started the login, otherwise someone
+	// could get a victim signed in to the attacker's account. lax so it survives the provider's redirect
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth/oauth",
+		MaxAge:   int(auth.OAuthStateExpiry.Seconds()),
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// CallbackHandler is where the provider redirects back to. it ends on the frontend either way,
+// with the refresh cookie set on success or an error code in the query otherwise
+func (h *OAuthHandler) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    "",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/api/auth/oauth",
+		MaxAge:   -1,
+	})
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		h.redirectOAuthError(w, r, "cancelled")
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		h.redirectOAuthError(w, r, "expired")
+		return
+	}
+
+	userId, err := h.OAuthService.Complete(r.Context(), chi.URLParam(r, "provider"), state, query.Get("code"))
+	switch {
+	case err == auth.ErrInvalidOAuthState || err == auth.ErrUnknownOAuthProvider:
+		h.redirectOAuthError(w, r, "expired")
+		return
+	case err == auth.ErrOAuthNoEmail:
+		h.redirectOAuthError(w, r, "no_verified_email")
+		return
+	case err == auth.ErrOAuthEmailInUse:
+		h.redirectOAuthError(w, r, "email_in_use")
+		return
+	case err != nil:
+		log.Printf("error completing oauth login: %v", err)
+		h.redirectOAuthError(w, r, "failed")
+		return
+	}
+
+	// the provider stands in for the password, not for the second factor
+	mfaEnabled, err := h.AuthService.IsMFAEnabled(r.Context(), userId)
+	if err != nil {
+		h.redirectOAuthError(w, r, "failed")
+		return
+	}
+	if mfaEnabled {
+		mfaToken, err := h.AuthService.GenerateMFAToken(userId)
+		if err != nil {
+			h.redirectOAuthError(w, r, "failed")
+			return
+		}
+		// in the fragment so it never reaches a server log
+		http.Redirect(w, r, h.AppURL+"/login/mfa#mfa_token="+url.QueryEscape(mfaToken), http.StatusFound)
+		return
+	}
+
+	_, refreshToken, err := h.AuthService.GenerateTokens(r.Context(), userId, auth.DeviceFromRequest(r))
+	if err != nil {
+		h.redirectOAuthError(w, r, "failed")
+		return
+	}
+
+	// the frontend trades the cookie for an access token through /api/users/refresh
+	setRefreshCookie(w, refreshToken)
+	http.Redirect(w, r, h.AppURL+"/oauth/callback", http.StatusFound)
+}
+
+func (h *OAuthHandler) redirectOAuthError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, h.AppURL+"/login?error="+url.QueryEscape(code), http.StatusFound)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+)
+
+type PasskeyHandler struct {
+	UserDAO        *dao.UserDAO
+	PasskeyService *auth.PasskeyService
+}
+
+func NewPasskeyHandler(userDAO *dao.UserDAO, passkeyService *auth.PasskeyService) *PasskeyHandler {
+	return &PasskeyHandler{UserDAO: userDAO, PasskeyService: passkeyService}
+}
+
+func (h *PasskeyHandler) GetPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	passkeys, err := h.PasskeyService.ListPasskeys(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting passkeys from database", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+// BeginRegistrationHandler returns the options to pass to navigator.credentials.create()
+func (h *PasskeyHandler) BeginRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	options, ceremonyId, err := h.PasskeyService.BeginRegistration(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error starting passkey registration", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"ceremony_id": ceremonyId,
+		"options":     options,
+	})
+}
+
+func (h *PasskeyHandler) FinishRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	var req struct {
+		CeremonyId string          `json:"ceremony_id" validate:"required"`
+		Name       string          `json:"name" validate:"max=100"`
+		Credential json.RawMessage `json:"credential" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+
+	passkey, err := h.PasskeyService.FinishRegistration(r.Context(), userId, req.CeremonyId, req.Name, req.Credential)
+	if err == auth.ErrInvalidCeremony {
+		response.WriteError(w, response.BadRequest("Passkey registration expired, try again").WithCode("ceremony_expired"))
+		return
+	}
+	if err == auth.ErrInvalidPasskey {
+		response.WriteError(w, response.BadRequest("Invalid passkey").WithCode("passkey_invalid"))
+		return
+	}
+	if err == auth.ErrPasskeyDuplicate {
+		response.WriteError(w, response.Conflict("Passkey is already registered").WithCode("passkey_taken"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error saving passkey", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+func (h *PasskeyHandler) DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	passkeyId64, err := strconv.ParseUint(chi.URLParam(r, "passkey_id"), 10, 32)
+	if err != nil {
+		response.WriteError(w, response.BadRequest("Invalid passkey id"))
+		return
+	}
+
+	err = h.PasskeyService.DeletePasskey(r.Context(), userId, uint(passkeyId64))
+	if err == auth.ErrPasskeyNotFound {
+		response.WriteError(w, response.NotFound("Passkey does not exist"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error deleting passkey", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BeginLoginHandler returns the options to pass to navigator.credentials.get()
+func (h *PasskeyHandler) BeginLoginHandler(w http.ResponseWriter, r *http.Request) {
+	options, ceremonyId, err := h.PasskeyService.BeginLogin(r.Context())
+	if err != nil {
+		response.WriteError(w, response.Internal("Error starting passkey login", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"ceremony_id": ceremonyId,
+		"options":     options,
+	})
+}
+
+func (h *PasskeyHandler) FinishLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CeremonyId string          `json:"ceremony_id" validate:"required"`
+		Credential json.RawMessage `json:"credential" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	userId, accessToken, refreshToken, err := h.PasskeyService.FinishLogin(r.Context(), req.CeremonyId, req.Credential, auth.DeviceFromRequest(r))
+	if err == auth.ErrInvalidCeremony {
+		response.WriteError(w, response.Unauthorized("Passkey login expired, try again").WithCode("ceremony_expired"))
+		return
+	}
+	if err == auth.ErrInvalidPasskey {
+		response.WriteError(w, response.Unauthorized("Invalid login credentials").WithCode("invalid_credentials"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error logging in with passkey", err))
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Unauthorized("User does not exist"))
+		return
+	}
+
+	writeLoginResponse(w, user, accessToken, refreshToken)
+}
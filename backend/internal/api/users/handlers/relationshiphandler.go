@@ -1,42 +1,50 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
 )
 
 const DefaultRelationshipPicture = "https://img.freepik.com/free-vector/gradient-heart_78370-478.jpg"
 
 type RelationshipHandler struct {
 	RelationshipDAO *dao.RelationshipDAO
+	Publisher       *realtime.Publisher
 }
 
-func NewRelationshipHandler(relationshipDAO *dao.RelationshipDAO) *RelationshipHandler {
-	return &RelationshipHandler{RelationshipDAO: relationshipDAO}
+func NewRelationshipHandler(relationshipDAO *dao.RelationshipDAO, publisher *realtime.Publisher) *RelationshipHandler {
+	return &RelationshipHandler{RelationshipDAO: relationshipDAO, Publisher: publisher}
 }
 
 func (h *RelationshipHandler) CreateRelationshipHandler(w http.ResponseWriter, r *http.Request) {
 	// get current user to make them the first member of the new relationship
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	var req struct {
-		Name    string `json:"name"`
-		Picture string `json:"picture"`
+		Name    string                  `json:"name" validate:"required,max=100"`
+		Picture string                  `json:"picture" validate:"url"`
+		Type    models.RelationshipType `json:"type" validate:"oneof=couple friends family group"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
@@ -45,10 +53,18 @@ func (h *RelationshipHandler) CreateRelationshipHandler(w http.ResponseWriter, r
 		picture = DefaultRelationshipPicture
 	}
 
-	relationship, err := h.RelationshipDAO.CreateRelationshipAndAddUser(r.Context(), req.Name, picture, userId)
+	// groups have the same limits everything had before there were types
+	if req.Type == "" {
+		req.Type = models.RelationshipGroup
+	}
+
+	relationship, err := h.RelationshipDAO.CreateRelationshipAndAddUser(r.Context(), req.Name, picture, req.Type, userId)
+	if limitErr := limitError(err); limitErr != nil {
+		response.WriteError(w, limitErr)
+		return
+	}
 	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "Error creating relationship in database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error creating relationship in database", err))
 		return
 	}
 
@@ -56,7 +72,7 @@ func (h *RelationshipHandler) CreateRelationshipHandler(w http.ResponseWriter, r
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(relationship)
 	if err != nil {
-		http.Error(w, "Error encoding new relationship to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding new relationship to JSON", err))
 		return
 	}
 }
@@ -66,21 +82,21 @@ func (h *RelationshipHandler) GetRelationshipHandler(w http.ResponseWriter, r *h
 
 	relationshipId64, err := strconv.ParseUint(idParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid relationship id"))
 		return
 	}
 	relationshipId := uint(relationshipId64)
 
 	relationship, err := h.RelationshipDAO.GetRelationshipById(r.Context(), relationshipId)
 	if err != nil {
-		http.Error(w, "Relationship does not exist", http.StatusNotFound)
+		response.WriteError(w, response.NotFound("Relationship does not exist"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(relationship)
 	if err != nil {
-		http.Error(w, "Error encoding relationship to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding relationship to JSON", err))
 		return
 	}
 }
@@ -89,31 +105,31 @@ func (h *RelationshipHandler) UpdateRelationshipHandler(w http.ResponseWriter, r
 	// get relationship info
 	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
 	if !ok {
-		http.Error(w, "Missing relationship ID", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
 		return
 	}
 
 	var req struct {
-		Name    *string `json:"name,omitempty"`
-		Picture *string `json:"picture,omitempty"`
+		Name    *string `json:"name,omitempty" validate:"notblank,max=100"`
+		Picture *string `json:"picture,omitempty" validate:"url"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
-	relationship, err := h.RelationshipDAO.UpdateRelationship(r.Context(), relationshipID, req)
+	relationship, err := h.RelationshipDAO.UpdateRelationship(r.Context(), relationshipID, dao.RelationshipUpdate(req))
 	if err != nil {
-		http.Error(w, "Error updating relationship", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error updating relationship", err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(relationship)
 	if err != nil {
-		http.Error(w, "Error encoding relationship to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding relationship to JSON", err))
 		return
 	}
 }
@@ -122,47 +138,56 @@ func (h *RelationshipHandler) DeleteRelationshipHandler(w http.ResponseWriter, r
 	// get user info
 	userID, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	// get relationship info
 	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
 	if !ok {
-		http.Error(w, "Missing relationship ID", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
 		return
 	}
 
 	// check to see if user is the only person in relationship
 	isOnly, err := h.RelationshipDAO.IsUserOnlyMember(r.Context(), userID, relationshipID)
 	if err != nil {
-		http.Error(w, "Error checking permissions", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error checking permissions", err))
 		return
 	}
 	if !isOnly {
-		http.Error(w, "Unauthorized, relationships can only be deleted if only one person belongs to them", http.StatusUnauthorized)
+		response.WriteError(w, response.Forbidden("Relationships can only be deleted once everyone else has left"))
 		return
 	}
 
 	err = h.RelationshipDAO.DeleteRelationship(r.Context(), relationshipID)
 	if err != nil {
-		http.Error(w, "Error deleting relationship", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error deleting relationship", err))
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// limitError turns a broken membership limit into the 409 it should be, or returns nil for any other error
+func limitError(err error) *response.Error {
+	var limitErr *dao.LimitError
+	if !errors.As(err, &limitErr) {
+		return nil
+	}
+	return response.Conflict(limitErr.Error()).WithCode(limitErr.Code)
+}
+
 func (h *RelationshipHandler) GetUserRelationshipsHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	relationships, err := h.RelationshipDAO.GetUserRelationships(r.Context(), userId)
 	if err != nil {
-		http.Error(w, "Error getting user relationships from database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error getting user relationships from database", err))
 		return
 	}
 
@@ -173,7 +198,7 @@ func (h *RelationshipHandler) GetUserRelationshipsHandler(w http.ResponseWriter,
 func (h *RelationshipHandler) GetRelationshipMembersHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
@@ -181,17 +206,159 @@ func (h *RelationshipHandler) GetRelationshipMembersHandler(w http.ResponseWrite
 
 	id64, err := strconv.ParseUint(idParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid relationship id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid relationship id"))
 		return
 	}
 	id := uint(id64)
 
 	members, err := h.RelationshipDAO.GetRelationshipMembers(r.Context(), id, userId)
 	if err != nil {
-		http.Error(w, "Error getting members from database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error getting members from database", err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(members)
 }
+
+func (h *RelationshipHandler) ChangeMemberRoleHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	memberId64, err := strconv.ParseUint(chi.URLParam(r, "user_id"), 10, 32)
+	if err != nil {
+		response.WriteError(w, response.BadRequest("Invalid user id"))
+		return
+	}
+	memberId := uint(memberId64)
+
+	// ownership only changes hands when the owner leaves, never by assigning the role
+	var req struct {
+		Role models.Role `json:"role" validate:"required,oneof=admin member viewer"`
+	}
+
+	err = validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	if memberId == userId {
+		response.WriteError(w, response.Forbidden("You can't change your own role").WithCode("insufficient_role"))
+		return
+	}
+
+	// nobody can act on someone at or above their own level, or hand out a role as high as theirs.
+	// the dao checks both roles in the same transaction as the update, so they can't change in between
+	member, err := h.RelationshipDAO.SetMemberRole(r.Context(), relationshipID, userId, memberId, req.Role)
+	if errors.Is(err, dao.ErrOutranked) {
+		response.WriteError(w, response.Forbidden("You can't give or take away that role").WithCode("insufficient_role"))
+		return
+	}
+	if err == pgx.ErrNoRows {
+		response.WriteError(w, response.NotFound("Member does not exist"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error changing member role", err))
+		return
+	}
+
+	h.Publisher.Publish(r.Context(), realtime.MemberRoleChanged, relationshipID, member)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+func (h *RelationshipHandler) LeaveRelationshipHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	removal, err := h.RelationshipDAO.RemoveMember(r.Context(), relationshipID, userId)
+	if err == pgx.ErrNoRows {
+		response.WriteError(w, response.NotFound("You're not a member of this relationship"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error leaving relationship", err))
+		return
+	}
+
+	publishRemoval(r.Context(), h.Publisher, realtime.MemberLeft, relationshipID, userId, removal)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *RelationshipHandler) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	relationshipID, ok := r.Context().Value(middleware.RelationshipIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.BadRequest("Missing relationship ID"))
+		return
+	}
+
+	memberId64, err := strconv.ParseUint(chi.URLParam(r, "user_id"), 10, 32)
+	if err != nil {
+		response.WriteError(w, response.BadRequest("Invalid user id"))
+		return
+	}
+	memberId := uint(memberId64)
+
+	if memberId == userId {
+		response.WriteError(w, response.BadRequest("Leave the relationship instead of removing yourself"))
+		return
+	}
+
+	removal, err := h.RelationshipDAO.RemoveMemberAs(r.Context(), relationshipID, userId, memberId)
+	if errors.Is(err, dao.ErrOutranked) {
+		response.WriteError(w, response.Forbidden("You can't remove that member").WithCode("insufficient_role"))
+		return
+	}
+	if err == pgx.ErrNoRows {
+		response.WriteError(w, response.NotFound("Member does not exist"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error removing member", err))
+		return
+	}
+
+	publishRemoval(r.Context(), h.Publisher, realtime.MemberRemoved, relationshipID, memberId, removal)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishRemoval tells the rest of a relationship someone is gone, and who owns it now if that changed
+func publishRemoval(ctx context.Context, publisher *realtime.Publisher, eventType string, relationshipID, userId uint, removal *models.MemberRemoval) {
+	// nobody is left to tell
+	if removal.RelationshipDeleted {
+		return
+	}
+	publisher.Publish(ctx, eventType, relationshipID, map[string]uint{"user_id": userId})
+	if removal.NewOwner != nil {
+		publisher.Publish(ctx, realtime.MemberRoleChanged, relationshipID, removal.NewOwner)
+	}
+}
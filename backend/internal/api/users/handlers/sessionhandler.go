@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
+	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+)
+
+type SessionHandler struct {
+	AuthService *auth.AuthService
+}
+
+func NewSessionHandler(authService *auth.AuthService) *SessionHandler {
+	return &SessionHandler{AuthService: authService}
+}
+
+func (h *SessionHandler) GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	sessionId, _ := r.Context().Value(middleware.SessionIDKey).(string)
+
+	sessions, err := h.AuthService.ListSessions(r.Context(), userId, sessionId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting sessions from database", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *SessionHandler) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	sessionId := chi.URLParam(r, "session_id")
+	if _, err := uuid.Parse(sessionId); err != nil {
+		response.WriteError(w, response.NotFound("Session does not exist"))
+		return
+	}
+
+	err := h.AuthService.RevokeSession(r.Context(), userId, sessionId)
+	if err == auth.ErrSessionNotFound {
+		response.WriteError(w, response.NotFound("Session does not exist"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking session", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *SessionHandler) RevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	err := h.AuthService.RevokeAllSessions(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking sessions", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,43 +1,148 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
 	config "github.com/theEricHoang/lovenote/backend/internal"
 	"github.com/theEricHoang/lovenote/backend/internal/api/auth"
 	"github.com/theEricHoang/lovenote/backend/internal/api/middleware"
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
 	"github.com/theEricHoang/lovenote/backend/internal/api/users/dao"
+	"github.com/theEricHoang/lovenote/backend/internal/api/users/models"
+	"github.com/theEricHoang/lovenote/backend/internal/api/validate"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/credentials"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/mailer"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/realtime"
 )
 
 const DefaultProfilePicture = "https://img.freepik.com/free-vector/gradient-heart_78370-478.jpg"
 
 var cfg config.Config = config.LoadConfig()
 
+// how long emailed links stay valid
+const (
+	VerificationTokenExpiry  = 24 * time.Hour
+	PasswordResetTokenExpiry = time.Hour
+	EmailChangeTokenExpiry   = 24 * time.Hour
+)
+
 type UserHandler struct {
 	UserDAO     *dao.UserDAO
+	TokenDAO    *dao.TokenDAO
 	AuthService *auth.AuthService
+	Throttle    *auth.LoginThrottle
+	Validator   *credentials.Validator
+	Mailer      mailer.Mailer
+	Publisher   *realtime.Publisher
+	// the frontend, which emailed links point at
+	AppURL string
+}
+
+func NewUserHandler(userDAO *dao.UserDAO, tokenDAO *dao.TokenDAO, authService *auth.AuthService, throttle *auth.LoginThrottle, validator *credentials.Validator, mailer mailer.Mailer, publisher *realtime.Publisher, appURL string) *UserHandler {
+	return &UserHandler{UserDAO: userDAO, TokenDAO: tokenDAO, AuthService: authService, Throttle: throttle, Validator: validator, Mailer: mailer, Publisher: publisher, AppURL: appURL}
+}
+
+// conflicts point at the field that caused them, like validation errors do
+var (
+	errUsernameTaken = response.Conflict("Username is already taken").WithCode("username_taken").WithFields(map[string][]string{"username": {"is already taken"}})
+	errEmailTaken    = response.Conflict("Email is already in use").WithCode("email_taken").WithFields(map[string][]string{"email": {"is already in use"}})
+)
+
+func refreshCookieSameSite() http.SameSite {
+	if !cfg.IsProduction {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteStrictMode
+}
+
+// the refresh cookie is sent to /refresh and to /logout, which has to work once the access token has expired
+const refreshCookiePath = "/api/users"
+
+// where the cookie used to live. a browser holding both would send the stale one to /refresh
+// first, which looks like reuse and ends the session, so it's cleared whenever the cookie is set
+const legacyRefreshCookiePath = "/api/users/refresh"
+
+func setRefreshCookie(w http.ResponseWriter, refreshToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: refreshCookieSameSite(),
+		Path:     refreshCookiePath,
+		MaxAge:   int(auth.RefreshTokenExpiry.Seconds()),
+	})
+	expireRefreshCookie(w, legacyRefreshCookiePath)
 }
 
-func NewUserHandler(userDAO *dao.UserDAO, authService *auth.AuthService) *UserHandler {
-	return &UserHandler{UserDAO: userDAO, AuthService: authService}
+func clearRefreshCookie(w http.ResponseWriter) {
+	expireRefreshCookie(w, refreshCookiePath)
+	expireRefreshCookie(w, legacyRefreshCookiePath)
+}
+
+func expireRefreshCookie(w http.ResponseWriter, path string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    "",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: refreshCookieSameSite(),
+		Path:     path,
+		MaxAge:   -1,              // remove immediately
+		Expires:  time.Unix(0, 0), // expire immediately
+	})
+}
+
+// sendVerificationEmail emails the user a link that confirms they own their current address
+func (h *UserHandler) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	err = h.TokenDAO.CreateToken(ctx, user.Id, models.TokenPurposeEmailVerification, user.Email, tokenHash, VerificationTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", h.AppURL, url.QueryEscape(token))
+	return h.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your lovenote email",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening the link below. It expires in 24 hours.\n\n%s\n\nIf you didn't create a lovenote account you can ignore this email.\n",
+			user.Username, link),
+	})
 }
 
 func (h *UserHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Username       string  `json:"username"`
 		Email          string  `json:"email"`
-		ProfilePicture *string `json:"profile_picture,omitempty"`
+		ProfilePicture *string `json:"profile_picture,omitempty" validate:"url"`
 		Password       string  `json:"password"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.DecodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	errs := validate.Struct(&req)
+	errs.Merge(h.Validator.Registration(req.Username, req.Email, req.Password))
+	if len(errs) > 0 {
+		response.WriteError(w, response.Invalid(errs))
 		return
 	}
 
@@ -49,19 +154,33 @@ func (h *UserHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	hashedPassword, err := h.AuthService.HashPassword(req.Password)
 	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error hashing password", err))
 		return
 	}
 
 	user, err := h.UserDAO.CreateUser(r.Context(), req.Username, req.Email, profilePicture, hashedPassword)
+	if err == dao.ErrUsernameTaken {
+		response.WriteError(w, errUsernameTaken)
+		return
+	}
+	if err == dao.ErrEmailTaken {
+		response.WriteError(w, errEmailTaken)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error creating user in database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error creating user in database", err))
 		return
 	}
 
-	accessToken, refreshToken, err := h.AuthService.GenerateTokens(r.Context(), user.Id)
+	// the account works without it, they can ask for another link if this one never arrives
+	err = h.sendVerificationEmail(r.Context(), user)
+	if err != nil {
+		log.Printf("error sending verification email to user %d: %v", user.Id, err)
+	}
+
+	accessToken, refreshToken, err := h.AuthService.GenerateTokens(r.Context(), user.Id, auth.DeviceFromRequest(r))
 	if err != nil {
-		http.Error(w, "Error generating tokens", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error generating tokens", err))
 		return
 	}
 
@@ -69,12 +188,14 @@ func (h *UserHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		Id             uint   `json:"id"`
 		Username       string `json:"username"`
 		Email          string `json:"email"`
+		EmailVerified  bool   `json:"email_verified"`
 		ProfilePicture string `json:"profile_picture"`
 		AccessToken    string `json:"access"`
 	}{
 		Id:             user.Id,
 		Username:       user.Username,
 		Email:          user.Email,
+		EmailVerified:  false,
 		ProfilePicture: profilePicture,
 		AccessToken:    accessToken,
 	}
@@ -83,58 +204,178 @@ func (h *UserHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	w.WriteHeader(http.StatusCreated)
 
-	sameSiteMode := http.SameSiteStrictMode
-	if !cfg.IsProduction {
-		sameSiteMode = http.SameSiteNoneMode
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: sameSiteMode,
-		Path:     "/api/users/refresh",
-		MaxAge:   60 * 60 * 24 * 7, // 7 days
-	})
+	setRefreshCookie(w, refreshToken)
 
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
-		http.Error(w, "Error encoding new user to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding new user to JSON", err))
 		return
 	}
 }
 
 func (h *UserHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
+	ip := auth.DeviceFromRequest(r).IPAddress
+	retryAfter, err := h.Throttle.Check(r.Context(), req.Username, ip)
+	if err == auth.ErrLoginLocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		response.WriteError(w, response.TooManyRequests("Too many failed login attempts, try again later").WithCode("login_locked"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error checking login attempts", err))
+		return
+	}
+
+	// a missing user and a wrong password look exactly the same from outside, including how long they take
 	user, err := h.UserDAO.GetUserByUsername(r.Context(), req.Username)
+	if err != nil && err != pgx.ErrNoRows {
+		response.WriteError(w, response.Internal("Error getting user from database", err))
+		return
+	}
+	if err == nil {
+		err = h.AuthService.CheckPassword(user.PasswordHash, req.Password)
+	} else {
+		h.AuthService.CheckDummyPassword(req.Password)
+	}
 	if err != nil {
-		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		if err := h.Throttle.RecordFailure(r.Context(), req.Username, ip); err != nil {
+			log.Printf("error recording failed login: %v", err)
+		}
+		response.WriteError(w, response.Unauthorized("Invalid username or password").WithCode("invalid_credentials"))
 		return
 	}
 
-	err = h.AuthService.CheckPassword(user.PasswordHash, req.Password)
+	// the plain password is only around now, so this is the moment to move it onto the current policy
+	if h.AuthService.PasswordNeedsRehash(user.PasswordHash) {
+		h.rehashPassword(r.Context(), user, req.Password)
+	}
+
+	mfaEnabled, err := h.AuthService.IsMFAEnabled(r.Context(), user.Id)
 	if err != nil {
-		http.Error(w, "Invalid login credentials", http.StatusUnauthorized)
+		response.WriteError(w, response.Internal("Error checking two-factor authentication", err))
 		return
 	}
+	// the password was right but there's no session until the second factor checks out too. the
+	// failed logins stay counted until it does, so wrong codes keep adding to the same lockout
+	if mfaEnabled {
+		mfaToken, err := h.AuthService.GenerateMFAToken(user.Id)
+		if err != nil {
+			response.WriteError(w, response.Internal("Error generating tokens", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+		})
+		return
+	}
+
+	err = h.Throttle.RecordSuccess(r.Context(), req.Username)
+	if err != nil {
+		log.Printf("error clearing failed logins: %v", err)
+	}
 
-	accessToken, refreshToken, err := h.AuthService.GenerateTokens(r.Context(), user.Id)
+	accessToken, refreshToken, err := h.AuthService.GenerateTokens(r.Context(), user.Id, auth.DeviceFromRequest(r))
 	if err != nil {
-		http.Error(w, "Error generating tokens", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error generating tokens", err))
 		return
 	}
 
+	writeLoginResponse(w, user, accessToken, refreshToken)
+}
+
+func (h *UserHandler) rehashPassword(ctx context.Context, user *models.User, password string) {
+	hashedPassword, err := h.AuthService.HashPassword(password)
+	if err != nil {
+		log.Printf("error rehashing password for user %d: %v", user.Id, err)
+		return
+	}
+	// a failure only means the old hash stays around until the next login
+	err = h.UserDAO.ReplacePasswordHash(ctx, user.Id, user.PasswordHash, hashedPassword)
+	if err != nil {
+		log.Printf("error saving rehashed password for user %d: %v", user.Id, err)
+	}
+}
+
+func (h *UserHandler) LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token" validate:"required"`
+		Code     string `json:"code" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	errLoginExpired := response.Unauthorized("Login expired, sign in again").WithCode("mfa_token_invalid")
+	userId, err := h.AuthService.MFATokenUser(req.MFAToken)
+	if err != nil {
+		response.WriteError(w, errLoginExpired)
+		return
+	}
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Unauthorized("User does not exist"))
+		return
+	}
+
+	// wrong codes lock the account out just like wrong passwords do
+	ip := auth.DeviceFromRequest(r).IPAddress
+	retryAfter, err := h.Throttle.Check(r.Context(), user.Username, ip)
+	if err == auth.ErrLoginLocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		response.WriteError(w, response.TooManyRequests("Too many failed login attempts, try again later").WithCode("login_locked"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error checking login attempts", err))
+		return
+	}
+
+	_, accessToken, refreshToken, err := h.AuthService.CompleteMFALogin(r.Context(), req.MFAToken, req.Code, auth.DeviceFromRequest(r))
+	if err == auth.ErrInvalidMFACode || err == auth.ErrInvalidMFAToken {
+		if err := h.Throttle.RecordFailure(r.Context(), user.Username, ip); err != nil {
+			log.Printf("error recording failed login: %v", err)
+		}
+	}
+	if err == auth.ErrInvalidMFAToken || err == auth.ErrMFANotSetUp {
+		response.WriteError(w, errLoginExpired)
+		return
+	}
+	if err == auth.ErrInvalidMFACode {
+		response.WriteError(w, response.Unauthorized("Invalid two-factor code").WithCode("mfa_code_invalid"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error verifying two-factor code", err))
+		return
+	}
+
+	// only now has the whole login succeeded
+	err = h.Throttle.RecordSuccess(r.Context(), user.Username)
+	if err != nil {
+		log.Printf("error clearing failed logins: %v", err)
+	}
+
+	writeLoginResponse(w, user, accessToken, refreshToken)
+}
+
+func writeLoginResponse(w http.ResponseWriter, user *models.User, accessToken, refreshToken string) {
 	res := struct {
 		Id             uint   `json:"id"`
 		Username       string `json:"username"`
@@ -152,40 +393,36 @@ func (h *UserHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
-	sameSiteMode := http.SameSiteStrictMode
-	if !cfg.IsProduction {
-		sameSiteMode = http.SameSiteNoneMode
-	}
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: sameSiteMode,
-		Path:     "/api/users/refresh",
-		MaxAge:   60 * 60 * 24 * 7, // 7 days
-	})
+	setRefreshCookie(w, refreshToken)
 
 	json.NewEncoder(w).Encode(res)
 }
 
+// LogoutHandler ends the session of a valid access token if there is one, and otherwise the
+// session of the refresh cookie, so clients whose access token has expired can still log out
 func (h *UserHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	sameSiteMode := http.SameSiteStrictMode
-	if !cfg.IsProduction {
-		sameSiteMode = http.SameSiteNoneMode
+	var err error
+	if userId, ok := r.Context().Value(middleware.UserIDKey).(uint); ok {
+		sessionId, _ := r.Context().Value(middleware.SessionIDKey).(string)
+		tokenId, _ := r.Context().Value(middleware.TokenIDKey).(string)
+		err = h.AuthService.Logout(r.Context(), userId, sessionId, tokenId)
+	} else if refreshToken, cookieErr := r.Cookie("refresh_token"); cookieErr == nil {
+		err = h.AuthService.LogoutRefreshToken(r.Context(), refreshToken.Value)
+	} else {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	if err == auth.ErrInvalidRefreshToken {
+		clearRefreshCookie(w)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error logging out", err))
+		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: sameSiteMode,
-		Path:     "/api/users/refresh",
-		MaxAge:   -1,              // remove immediately
-		Expires:  time.Unix(0, 0), // expire immediately
-	})
+	clearRefreshCookie(w)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Logged out successfully"))
@@ -194,58 +431,401 @@ func (h *UserHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 func (h *UserHandler) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := r.Cookie("refresh_token")
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+
+	newAccess, newRefresh, err := h.AuthService.RefreshTokens(r.Context(), refreshToken.Value, auth.DeviceFromRequest(r))
+	if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+		clearRefreshCookie(w)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error generating new tokens", err))
 		return
 	}
 
-	claims, err := h.AuthService.ValidateToken(refreshToken.Value)
+	res := struct {
+		AccessToken string `json:"access"`
+	}{
+		AccessToken: newAccess,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	setRefreshCookie(w, newRefresh)
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *UserHandler) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		response.WriteError(w, err)
 		return
 	}
 
-	realToken, err := h.AuthService.GetRefreshToken(r.Context(), claims.UserId)
+	_, err = h.TokenDAO.VerifyEmail(r.Context(), auth.HashToken(req.Token))
+	if err == dao.ErrInvalidToken {
+		response.WriteError(w, response.BadRequest("Invalid or expired verification link").WithCode("invalid_token"))
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error getting refresh token from database", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error verifying email", err))
 		return
 	}
 
-	if refreshToken.Value != realToken {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified successfully!"})
+}
+
+func (h *UserHandler) ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
-	newAccess, newRefresh, err := h.AuthService.GenerateTokens(r.Context(), claims.UserId)
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
 	if err != nil {
-		http.Error(w, "Error generating new tokens", http.StatusInternalServerError)
+		response.WriteError(w, response.NotFound("User does not exist"))
+		return
+	}
+	if user.EmailVerified {
+		response.WriteError(w, response.Conflict("Email is already verified").WithCode("email_already_verified"))
 		return
 	}
 
-	res := struct {
-		AccessToken string `json:"access"`
-	}{
-		AccessToken: newAccess,
+	err = h.sendVerificationEmail(r.Context(), user)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error sending verification email", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordResetEmail emails the user a link to choose a new password
+func (h *UserHandler) sendPasswordResetEmail(ctx context.Context, user *models.User) error {
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
 	}
 
+	err = h.TokenDAO.CreateToken(ctx, user.Id, models.TokenPurposePasswordReset, user.Email, tokenHash, PasswordResetTokenExpiry)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", h.AppURL, url.QueryEscape(token))
+	return h.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your lovenote password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your lovenote account. Open the link below within an hour to choose a new one.\n\n%s\n\nIf it wasn't you, you can ignore this email and your password won't change.\n",
+			user.Username, link),
+	})
+}
+
+func (h *UserHandler) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	// the response is the same whether or not the account exists, and the email goes out in the
+	// background so how long we take doesn't give it away either
+	go func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+
+		user, err := h.UserDAO.GetUserByEmail(ctx, req.Email)
+		if err != nil {
+			if err != pgx.ErrNoRows {
+				log.Printf("error looking up user for password reset: %v", err)
+			}
+			return
+		}
+
+		err = h.sendPasswordResetEmail(ctx, user)
+		if err != nil {
+			log.Printf("error sending password reset email to user %d: %v", user.Id, err)
+		}
+	}(context.WithoutCancel(r.Context()))
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If an account uses that email, a password reset link is on its way."})
+}
 
-	sameSiteMode := http.SameSiteStrictMode
-	if !cfg.IsProduction {
-		sameSiteMode = http.SameSiteNoneMode
+func (h *UserHandler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password"`
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    newRefresh,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: sameSiteMode,
-		Path:     "/api/users/refresh",
-		MaxAge:   60 * 60 * 24 * 7, // 7 days
+	err := validate.DecodeJSON(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		response.WriteError(w, response.Invalid(errs))
+		return
+	}
+
+	// the new password is checked against the account's username and email like any other
+	tokenHash := auth.HashToken(req.Token)
+	tokenUserId, err := h.TokenDAO.GetTokenUser(r.Context(), tokenHash, models.TokenPurposePasswordReset)
+	if err == dao.ErrInvalidToken {
+		response.WriteError(w, response.BadRequest("Invalid or expired reset link").WithCode("invalid_token"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error checking reset link", err))
+		return
+	}
+	user, err := h.UserDAO.GetUserById(r.Context(), tokenUserId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error getting user from database", err))
+		return
+	}
+	if problems := h.Validator.Password(req.Password, user.Username, user.Email); len(problems) > 0 {
+		response.WriteError(w, response.Invalid(validate.Errors{"password": problems}))
+		return
+	}
+
+	hashedPassword, err := h.AuthService.HashPassword(req.Password)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error hashing password", err))
+		return
+	}
+
+	userId, err := h.TokenDAO.ResetPassword(r.Context(), tokenHash, hashedPassword)
+	if err == dao.ErrInvalidToken {
+		response.WriteError(w, response.BadRequest("Invalid or expired reset link").WithCode("invalid_token"))
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error resetting password", err))
+		return
+	}
+
+	// whoever had the old password shouldn't stay signed in
+	err = h.AuthService.RevokeAllSessions(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking sessions", err))
+		return
+	}
+
+	clearRefreshCookie(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully!"})
+}
+
+// notify sends a security notice. they're best effort, a mail outage shouldn't undo the change it describes
+func (h *UserHandler) notify(ctx context.Context, to, subject, body string) {
+	err := h.Mailer.Send(ctx, mailer.Message{To: to, Subject: subject, Body: body})
+	if err != nil {
+		log.Printf("error sending %q notification: %v", subject, err)
+	}
+}
+
+func (h *UserHandler) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	sessionId, _ := r.Context().Value(middleware.SessionIDKey).(string)
+
+	var req struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.NotFound("User does not exist"))
+		return
+	}
+
+	err = h.AuthService.CheckPassword(user.PasswordHash, req.CurrentPassword)
+	if err != nil {
+		response.WriteError(w, response.Forbidden("Current password is incorrect").WithCode("invalid_credentials"))
+		return
+	}
+
+	if problems := h.Validator.Password(req.NewPassword, user.Username, user.Email); len(problems) > 0 {
+		response.WriteError(w, response.Invalid(credentials.FieldErrors{"new_password": problems}))
+		return
+	}
+
+	hashedPassword, err := h.AuthService.HashPassword(req.NewPassword)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error hashing password", err))
+		return
+	}
+
+	err = h.UserDAO.UpdatePassword(r.Context(), userId, hashedPassword)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error updating password", err))
+		return
+	}
+
+	err = h.AuthService.RevokeOtherSessions(r.Context(), userId, sessionId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking sessions", err))
+		return
+	}
+
+	h.notify(r.Context(), user.Email, "Your lovenote password was changed",
+		fmt.Sprintf("Hi %s,\n\nThe password for your lovenote account was just changed and every other device was signed out.\n\nIf this wasn't you, reset your password right away at %s/forgot-password.\n", user.Username, h.AppURL))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully!"})
+}
+
+// ChangeEmailHandler starts an email change. nothing changes until the link sent to the new address is followed
+func (h *UserHandler) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
+	if !ok {
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
+		return
+	}
+	sessionId, _ := r.Context().Value(middleware.SessionIDKey).(string)
+
+	var req struct {
+		Password string `json:"password" validate:"required"`
+		Email    string `json:"email"`
+	}
+
+	err := validate.DecodeJSON(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	errs := validate.Struct(&req)
+	errs.Merge(map[string][]string{"email": h.Validator.Email(req.Email)})
+	if len(errs) > 0 {
+		response.WriteError(w, response.Invalid(errs))
+		return
+	}
+
+	user, err := h.UserDAO.GetUserById(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.NotFound("User does not exist"))
+		return
+	}
+
+	err = h.AuthService.CheckPassword(user.PasswordHash, req.Password)
+	if err != nil {
+		response.WriteError(w, response.Forbidden("Password is incorrect").WithCode("invalid_credentials"))
+		return
+	}
+
+	if req.Email == user.Email {
+		response.WriteError(w, response.BadRequest("That is already your email"))
+		return
+	}
+	_, err = h.UserDAO.GetUserByEmail(r.Context(), req.Email)
+	if err == nil {
+		response.WriteError(w, errEmailTaken)
+		return
+	}
+	if err != pgx.ErrNoRows {
+		response.WriteError(w, response.Internal("Error checking email", err))
+		return
+	}
+
+	token, tokenHash, err := auth.NewOpaqueToken()
+	if err != nil {
+		response.WriteError(w, response.Internal("Error generating token", err))
+		return
+	}
+
+	err = h.TokenDAO.CreateToken(r.Context(), userId, models.TokenPurposeEmailChange, req.Email, tokenHash, EmailChangeTokenExpiry)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error saving token", err))
+		return
+	}
+
+	link := fmt.Sprintf("%s/confirm-email?token=%s", h.AppURL, url.QueryEscape(token))
+	err = h.Mailer.Send(r.Context(), mailer.Message{
+		To:      req.Email,
+		Subject: "Confirm your new lovenote email",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below to start using this address for your lovenote account. It expires in 24 hours.\n\n%s\n\nIf you didn't ask for this you can ignore this email.\n",
+			user.Username, link),
 	})
+	if err != nil {
+		response.WriteError(w, response.Internal("Error sending confirmation email", err))
+		return
+	}
 
-	json.NewEncoder(w).Encode(res)
+	err = h.AuthService.RevokeOtherSessions(r.Context(), userId, sessionId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error revoking sessions", err))
+		return
+	}
+
+	h.notify(r.Context(), user.Email, "Your lovenote email is being changed",
+		fmt.Sprintf("Hi %s,\n\nSomeone asked to move your lovenote account to %s and every other device was signed out. The change only happens once the new address is confirmed.\n\nIf this wasn't you, reset your password right away at %s/forgot-password.\n", user.Username, req.Email, h.AppURL))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Check your new email for a confirmation link."})
+}
+
+func (h *UserHandler) ConfirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token" validate:"required"`
+	}
+
+	err := validate.Decode(w, r, &req)
+	if err != nil {
+		response.WriteError(w, err)
+		return
+	}
+
+	_, oldEmail, newEmail, err := h.TokenDAO.ChangeEmail(r.Context(), auth.HashToken(req.Token))
+	if err == dao.ErrInvalidToken {
+		response.WriteError(w, response.BadRequest("Invalid or expired confirmation link").WithCode("invalid_token"))
+		return
+	}
+	if err == dao.ErrEmailTaken {
+		response.WriteError(w, errEmailTaken)
+		return
+	}
+	if err != nil {
+		response.WriteError(w, response.Internal("Error changing email", err))
+		return
+	}
+
+	h.notify(r.Context(), oldEmail, "Your lovenote email was changed",
+		fmt.Sprintf("Hi,\n\nYour lovenote account now uses %s, so we won't send anything to this address anymore.\n\nIf this wasn't you, contact us right away.\n", newEmail))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email changed successfully!"})
 }
 
 func (h *UserHandler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -253,14 +833,14 @@ func (h *UserHandler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	userId64, err := strconv.ParseUint(idParam, 10, 32)
 	if err != nil {
-		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Invalid user id"))
 		return
 	}
 	userId := uint(userId64)
 
 	user, err := h.UserDAO.GetUserById(r.Context(), userId)
 	if err != nil {
-		http.Error(w, "User does not exist", http.StatusNotFound)
+		response.WriteError(w, response.NotFound("User does not exist"))
 		return
 	}
 
@@ -279,7 +859,7 @@ func (h *UserHandler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
-		http.Error(w, "Error encoding user to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding user to JSON", err))
 		return
 	}
 }
@@ -287,13 +867,13 @@ func (h *UserHandler) GetUserHandler(w http.ResponseWriter, r *http.Request) {
 func (h *UserHandler) GetSelfHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	user, err := h.UserDAO.GetUserById(r.Context(), userID)
 	if err != nil {
-		http.Error(w, "User does not exist", http.StatusNotFound)
+		response.WriteError(w, response.NotFound("User does not exist"))
 		return
 	}
 
@@ -302,19 +882,21 @@ func (h *UserHandler) GetSelfHandler(w http.ResponseWriter, r *http.Request) {
 		Username       string `json:"username"`
 		ProfilePicture string `json:"profile_picture"`
 		Email          string `json:"email"`
+		EmailVerified  bool   `json:"email_verified"`
 		Bio            string `json:"bio"`
 	}{
 		Id:             user.Id,
 		Username:       user.Username,
 		ProfilePicture: user.ProfilePicture,
 		Email:          user.Email,
+		EmailVerified:  user.EmailVerified,
 		Bio:            user.Bio,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
-		http.Error(w, "Error encoding user to JSON", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error encoding user to JSON", err))
 		return
 	}
 }
@@ -322,32 +904,45 @@ func (h *UserHandler) GetSelfHandler(w http.ResponseWriter, r *http.Request) {
 func (h *UserHandler) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
 	var req struct {
 		Username       *string `json:"username,omitempty"`
-		ProfilePicture *string `json:"profile_picture,omitempty"`
-		Bio            *string `json:"bio,omitempty"`
+		ProfilePicture *string `json:"profile_picture,omitempty" validate:"url"`
+		Bio            *string `json:"bio,omitempty" validate:"max=300"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := validate.DecodeJSON(w, r, &req)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		response.WriteError(w, err)
 		return
 	}
 
-	err = h.UserDAO.UpdateUser(r.Context(), userId, req)
+	errs := validate.Struct(&req)
+	if req.Username != nil {
+		errs.Merge(map[string][]string{"username": h.Validator.Username(*req.Username)})
+	}
+	if len(errs) > 0 {
+		response.WriteError(w, response.Invalid(errs))
+		return
+	}
+
+	err = h.UserDAO.UpdateUser(r.Context(), userId, dao.UserUpdate(req))
+	if err == dao.ErrUsernameTaken {
+		response.WriteError(w, errUsernameTaken)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error updating user", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error updating user", err))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully!"})
 	if err != nil {
-		http.Error(w, "Error writing response", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error writing response", err))
 		return
 	}
 }
@@ -355,23 +950,35 @@ func (h *UserHandler) UpdateUserHandler(w http.ResponseWriter, r *http.Request)
 func (h *UserHandler) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	userId, ok := r.Context().Value(middleware.UserIDKey).(uint)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		response.WriteError(w, response.Unauthorized("Unauthorized"))
 		return
 	}
 
-	err := h.UserDAO.DeleteUser(r.Context(), userId)
+	// revoke first so the account's access tokens stop working the moment it's gone
+	err := h.AuthService.RevokeAllSessions(r.Context(), userId)
 	if err != nil {
-		http.Error(w, "Error deleting user", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Error revoking sessions", err))
 		return
 	}
 
+	removals, err := h.UserDAO.DeleteUser(r.Context(), userId)
+	if err != nil {
+		response.WriteError(w, response.Internal("Error deleting user", err))
+		return
+	}
+	for relationshipID, removal := range removals {
+		publishRemoval(r.Context(), h.Publisher, realtime.MemberLeft, relationshipID, userId, removal)
+	}
+
+	clearRefreshCookie(w)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *UserHandler) SearchUsersHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
 	if username == "" {
-		http.Error(w, "Missing 'username' query parameter", http.StatusBadRequest)
+		response.WriteError(w, response.BadRequest("Missing 'username' query parameter"))
 		return
 	}
 
@@ -391,7 +998,7 @@ func (h *UserHandler) SearchUsersHandler(w http.ResponseWriter, r *http.Request)
 
 	users, userCount, err := h.UserDAO.SearchUsersByName(r.Context(), username, limit, offset)
 	if err != nil {
-		http.Error(w, "Failed to search users", http.StatusInternalServerError)
+		response.WriteError(w, response.Internal("Failed to search users", err))
 		return
 	}
 
@@ -408,7 +1015,7 @@ func (h *UserHandler) SearchUsersHandler(w http.ResponseWriter, r *http.Request)
 		prevLink = &prev
 	}
 
-	response := map[string]any{
+	res := map[string]any{
 		"count": userCount,
 		"next":  nextLink,
 		"prev":  prevLink,
@@ -416,5 +1023,5 @@ func (h *UserHandler) SearchUsersHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(res)
 }
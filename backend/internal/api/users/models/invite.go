@@ -1,6 +1,21 @@
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
+
+type InviteStatus string
+
+const (
+	InvitePending  InviteStatus = "pending"
+	InviteAccepted InviteStatus = "accepted"
+	// the invitee turned it down
+	InviteDeclined InviteStatus = "declined"
+	// the inviter or an admin took it back
+	InviteCancelled InviteStatus = "cancelled"
+	InviteExpired   InviteStatus = "expired"
+)
 
 type Invite struct {
 	Id           uint          `json:"id,omitempty"`
@@ -8,6 +23,10 @@ type Invite struct {
 	Inviter      *User         `json:"inviter,omitempty"`
 	Invitee      *User         `json:"invitee,omitempty"`
 	Body         string        `json:"body,omitempty"`
+	Status       InviteStatus  `json:"status,omitempty"`
+	CreatedAt    *time.Time    `json:"created_at,omitempty"`
+	ExpiresAt    *time.Time    `json:"expires_at,omitempty"`
+	RespondedAt  *time.Time    `json:"responded_at,omitempty"`
 }
 
 func (i *Invite) ToJSON(view string) ([]byte, error) {
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// InviteLink is an invite to a relationship that anyone holding its token can redeem. The token
+// itself is only ever shown to whoever created the link
+type InviteLink struct {
+	Id             uint       `json:"id"`
+	RelationshipId uint       `json:"relationship_id"`
+	CreatedBy      *User      `json:"created_by,omitempty"`
+	Email          string     `json:"email,omitempty"`
+	MaxUses        *int       `json:"max_uses"`
+	Uses           int        `json:"uses"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+// InviteLinkPreview is what someone holding a link gets to see before they have an account
+type InviteLinkPreview struct {
+	Relationship  *Relationship `json:"relationship"`
+	InvitedBy     *User         `json:"invited_by,omitempty"`
+	Members       int           `json:"members"`
+	EmailRequired bool          `json:"email_required"`
+	ExpiresAt     time.Time     `json:"expires_at"`
+}
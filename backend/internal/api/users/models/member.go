@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Role is what a member is allowed to do in a relationship. Every role can do everything the
+// roles below it can
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+	// viewers can read the board but not write on it
+	RoleViewer Role = "viewer"
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer: 1,
+	RoleMember: 2,
+	RoleAdmin:  3,
+	RoleOwner:  4,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// AtLeast reports whether r can do everything other can
+func (r Role) AtLeast(other Role) bool {
+	return roleRanks[r] >= roleRanks[other]
+}
+
+// Outranks reports whether r can do more than other
+func (r Role) Outranks(other Role) bool {
+	return roleRanks[r] > roleRanks[other]
+}
+
+// Member is a user as seen from inside one of their relationships
+type Member struct {
+	Id             uint       `json:"id"`
+	Username       string     `json:"username"`
+	ProfilePicture string     `json:"profile_picture"`
+	Role           Role       `json:"role"`
+	JoinedAt       *time.Time `json:"joined_at,omitempty"`
+}
+
+// MemberRemoval is what else changed when someone left or was removed from a relationship
+type MemberRemoval struct {
+	// set when the owner left and someone else took over
+	NewOwner *Member
+	// the last member left, so the relationship is gone
+	RelationshipDeleted bool
+}
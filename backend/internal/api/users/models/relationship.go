@@ -5,11 +5,21 @@ import (
 	"time"
 )
 
+type RelationshipType string
+
+const (
+	RelationshipCouple  RelationshipType = "couple"
+	RelationshipFriends RelationshipType = "friends"
+	RelationshipFamily  RelationshipType = "family"
+	RelationshipGroup   RelationshipType = "group"
+)
+
 type Relationship struct {
-	Id        uint       `json:"id,omitempty"`
-	Name      string     `json:"name,omitempty"`
-	Picture   string     `json:"picture,omitempty"`
-	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Id        uint             `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Picture   string           `json:"picture,omitempty"`
+	Type      RelationshipType `json:"type,omitempty"`
+	CreatedAt *time.Time       `json:"created_at,omitempty"`
 }
 
 func (r *Relationship) ToJSON(view string) ([]byte, error) {
@@ -9,6 +9,7 @@ type User struct {
 	Id             uint       `json:"id,omitempty"`
 	Username       string     `json:"username,omitempty"`
 	Email          string     `json:"email,omitempty"`
+	EmailVerified  bool       `json:"email_verified,omitempty"`
 	ProfilePicture string     `json:"profile_picture,omitempty"`
 	Bio            string     `json:"bio,omitempty"`
 	PasswordHash   string     `json:"-"`
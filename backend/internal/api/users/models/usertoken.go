@@ -0,0 +1,14 @@
+package models
+
+const (
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailChange       = "email_change"
+)
+
+// UserToken is a single use token we emailed to a user. only its hash is ever stored
+type UserToken struct {
+	UserId  uint
+	Purpose string
+	Email   string
+}
@@ -0,0 +1,270 @@
+// Package validate decodes JSON request bodies and checks them against the rules in their
+// validate struct tags, collecting every violation instead of stopping at the first one.
+//
+// Rules are comma separated:
+//
+//	required       present, and for strings not blank
+//	notblank       for strings that can be left out, like in partial updates: not blank when sent
+//	min=N, max=N   length for strings (in characters) and slices, value for numbers
+//	oneof=a b c    one of the space separated values
+//	email          a plain address like someone@example.com
+//	url            an absolute http or https url
+//	hexcolor       a #RRGGBB color
+//
+// Pointer fields other than required ones are only checked when they're set, so partial updates
+// can leave fields out. Blank strings skip the format rules, except in pointers that were set. Request types can add checks the tags can't express by implementing Validator.
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+)
+
+// MaxBodyBytes caps how much of a request body Decode reads
+const MaxBodyBytes = 1 << 20
+
+// Errors maps json field names to everything wrong with them
+type Errors map[string][]string
+
+func (e Errors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Merge adds problems found by checks outside this package, such as the password policy
+func (e Errors) Merge(other map[string][]string) {
+	for field, problems := range other {
+		if len(problems) > 0 {
+			e[field] = append(e[field], problems...)
+		}
+	}
+}
+
+// Validator is implemented by request types with checks that go beyond their tags, such as
+// rules involving more than one field
+type Validator interface {
+	Validate(errs Errors)
+}
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Decode reads the JSON body of r into dst, a pointer to a struct, and validates it. The
+// returned error is a *response.Error ready to be written
+func Decode(w http.ResponseWriter, r *http.Request, dst any) error {
+	if err := DecodeJSON(w, r, dst); err != nil {
+		return err
+	}
+	if errs := Struct(dst); len(errs) > 0 {
+		return response.Invalid(errs)
+	}
+	return nil
+}
+
+// DecodeJSON is Decode without the validation, for handlers that add their own problems to
+// what Struct finds before responding. Unknown fields, trailing data and bodies over
+// MaxBodyBytes are still rejected
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	if decoder.More() {
+		return response.BadRequest("Request body must be a single JSON object").WithCode("invalid_json")
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return response.BadRequest("Request body must be a single JSON object").WithCode("invalid_json")
+	}
+	return nil
+}
+
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return response.BadRequest("Request body is required").WithCode("invalid_json")
+	case errors.As(err, &maxBytesErr):
+		return response.New(http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("Request body must be at most %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return response.BadRequest("Invalid request body").WithCode("invalid_json")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return response.Invalid(Errors{typeErr.Field: {"must be " + describeType(typeErr.Type)}})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for this one
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return response.BadRequest("Unknown field " + field).WithCode("unknown_field")
+	}
+	return response.BadRequest("Invalid request body").WithCode("invalid_json")
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+// Struct checks the validate tags of v, a struct or pointer to one, and runs its Validate
+// method if it has one
+func Struct(v any) Errors {
+	errs := Errors{}
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() == reflect.Struct {
+		checkStruct(value, errs)
+	}
+	if validator, ok := v.(Validator); ok {
+		validator.Validate(errs)
+	}
+	return errs
+}
+
+func checkStruct(value reflect.Value, errs Errors) {
+	t := value.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := jsonName(field)
+		for _, problem := range checkField(value.Field(i), tag) {
+			errs.Add(name, problem)
+		}
+	}
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func checkField(value reflect.Value, tag string) []string {
+	rules := strings.Split(tag, ",")
+
+	required := slices.Contains(rules, "required")
+	sent := false
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if required {
+				return []string{"is required"}
+			}
+			// optional fields are only checked when they're sent
+			return nil
+		}
+		value = value.Elem()
+		sent = true
+	}
+
+	if required && value.IsZero() {
+		return []string{"is required"}
+	}
+	if value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "" {
+		if required {
+			return []string{"is required"}
+		}
+		if slices.Contains(rules, "notblank") {
+			return []string{"must not be blank"}
+		}
+		// the format rules don't apply to a plain field that was left empty, but a pointer that was
+		// sent blank would be saved as is
+		if !sent {
+			return checkLengths(value, rules)
+		}
+	}
+
+	problems := checkLengths(value, rules)
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "oneof":
+			options := strings.Fields(arg)
+			if !slices.Contains(options, fmt.Sprint(value.Interface())) {
+				problems = append(problems, "must be one of "+strings.Join(options, ", "))
+			}
+		case "email":
+			if address, err := mail.ParseAddress(value.String()); err != nil || address.Address != value.String() {
+				problems = append(problems, "must be a valid email address")
+			}
+		case "url":
+			if u, err := url.Parse(value.String()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems = append(problems, "must be an http or https url")
+			}
+		case "hexcolor":
+			if !hexColorPattern.MatchString(value.String()) {
+				problems = append(problems, "must be a color like #FF88AA")
+			}
+		case "required", "notblank", "min", "max":
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q", rule))
+		}
+	}
+	return problems
+}
+
+func checkLengths(value reflect.Value, rules []string) []string {
+	var problems []string
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name != "min" && name != "max" {
+			continue
+		}
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad limit in %q", rule))
+		}
+
+		var size float64
+		var unit string
+		switch value.Kind() {
+		case reflect.String:
+			size, unit = float64(utf8.RuneCountInString(value.String())), " characters"
+		case reflect.Slice, reflect.Array, reflect.Map:
+			size, unit = float64(value.Len()), " items"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			size = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			size = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			size = value.Float()
+		default:
+			panic(fmt.Sprintf("validate: %s doesn't apply to %s", name, value.Kind()))
+		}
+
+		if name == "min" && size < limit {
+			problems = append(problems, fmt.Sprintf("must be at least %s%s", arg, unit))
+		}
+		if name == "max" && size > limit {
+			problems = append(problems, fmt.Sprintf("must be at most %s%s", arg, unit))
+		}
+	}
+	return problems
+}
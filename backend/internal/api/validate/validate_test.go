@@ -0,0 +1,204 @@
+package validate
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/theEricHoang/lovenote/backend/internal/api/response"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestStruct(t *testing.T) {
+	type request struct {
+		Name     string   `json:"name" validate:"required,max=5"`
+		Bio      *string  `json:"bio" validate:"notblank,max=5"`
+		Title    *string  `json:"title" validate:"required"`
+		Role     string   `json:"role" validate:"oneof=owner member"`
+		Email    string   `json:"email" validate:"email"`
+		Website  *string  `json:"website" validate:"url"`
+		Color    string   `json:"color" validate:"hexcolor"`
+		Border   *string  `json:"border" validate:"hexcolor"`
+		Age      int      `json:"age" validate:"min=13,max=130"`
+		Score    *float32 `json:"score" validate:"min=0,max=1"`
+		Tags     []string `json:"tags" validate:"max=2"`
+		Password string   `validate:"min=3"`
+		Ignored  string   `json:"ignored" validate:"-"`
+	}
+	valid := func() request {
+		return request{Name: "ann", Title: ptr("hi"), Role: "owner", Email: "ann@example.com", Color: "#FF88aa", Age: 30, Password: "abc"}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *request)
+		want   Errors
+	}{
+		{"valid", func(r *request) {}, Errors{}},
+
+		{"required missing", func(r *request) { r.Name = "" }, Errors{"name": {"is required"}}},
+		{"required blank", func(r *request) { r.Name = "  " }, Errors{"name": {"is required"}}},
+		{"required nil pointer", func(r *request) { r.Title = nil }, Errors{"title": {"is required"}}},
+		{"required pointer to blank", func(r *request) { r.Title = ptr(" ") }, Errors{"title": {"is required"}}},
+
+		{"notblank nil pointer", func(r *request) { r.Bio = nil }, Errors{}},
+		{"notblank set", func(r *request) { r.Bio = ptr("hey") }, Errors{}},
+		{"notblank empty", func(r *request) { r.Bio = ptr("") }, Errors{"bio": {"must not be blank"}}},
+		{"notblank blank", func(r *request) { r.Bio = ptr(" \t") }, Errors{"bio": {"must not be blank"}}},
+		{"notblank too long", func(r *request) { r.Bio = ptr("hello!") }, Errors{"bio": {"must be at most 5 characters"}}},
+
+		{"max counts characters", func(r *request) { r.Name = "ünïcö" }, Errors{}},
+		{"max too long", func(r *request) { r.Name = "annabel" }, Errors{"name": {"must be at most 5 characters"}}},
+		{"min too short, no json name", func(r *request) { r.Password = "ab" }, Errors{"Password": {"must be at least 3 characters"}}},
+		{"min number", func(r *request) { r.Age = 12 }, Errors{"age": {"must be at least 13"}}},
+		{"max number", func(r *request) { r.Age = 131 }, Errors{"age": {"must be at most 130"}}},
+		{"number pointer nil", func(r *request) { r.Score = nil }, Errors{}},
+		{"number pointer in range", func(r *request) { r.Score = ptr[float32](0.5) }, Errors{}},
+		{"number pointer out of range", func(r *request) { r.Score = ptr[float32](-1) }, Errors{"score": {"must be at least 0"}}},
+		{"max items", func(r *request) { r.Tags = []string{"a", "b", "c"} }, Errors{"tags": {"must be at most 2 items"}}},
+
+		{"oneof", func(r *request) { r.Role = "member" }, Errors{}},
+		{"oneof other", func(r *request) { r.Role = "admin" }, Errors{"role": {"must be one of owner, member"}}},
+		{"oneof left empty", func(r *request) { r.Role = "" }, Errors{}},
+
+		{"email with a name", func(r *request) { r.Email = "Ann <ann@example.com>" }, Errors{"email": {"must be a valid email address"}}},
+		{"email without a domain", func(r *request) { r.Email = "ann" }, Errors{"email": {"must be a valid email address"}}},
+		{"email left empty", func(r *request) { r.Email = "" }, Errors{}},
+
+		{"url nil pointer", func(r *request) { r.Website = nil }, Errors{}},
+		{"url https", func(r *request) { r.Website = ptr("https://example.com/me") }, Errors{}},
+		{"url other scheme", func(r *request) { r.Website = ptr("javascript:alert(1)") }, Errors{"website": {"must be an http or https url"}}},
+		{"url relative", func(r *request) { r.Website = ptr("/me") }, Errors{"website": {"must be an http or https url"}}},
+		{"url empty", func(r *request) { r.Website = ptr("") }, Errors{"website": {"must be an http or https url"}}},
+		{"url blank", func(r *request) { r.Website = ptr("   ") }, Errors{"website": {"must be an http or https url"}}},
+
+		{"hexcolor short", func(r *request) { r.Color = "#FFF" }, Errors{"color": {"must be a color like #FF88AA"}}},
+		{"hexcolor without hash", func(r *request) { r.Color = "FF88AA" }, Errors{"color": {"must be a color like #FF88AA"}}},
+		{"hexcolor not hex", func(r *request) { r.Color = "#GG88AA" }, Errors{"color": {"must be a color like #FF88AA"}}},
+		{"hexcolor left empty", func(r *request) { r.Color = "" }, Errors{}},
+		{"hexcolor left blank", func(r *request) { r.Color = "  " }, Errors{}},
+		{"hexcolor pointer nil", func(r *request) { r.Border = nil }, Errors{}},
+		{"hexcolor pointer set", func(r *request) { r.Border = ptr("#000000") }, Errors{}},
+		{"hexcolor pointer empty", func(r *request) { r.Border = ptr("") }, Errors{"border": {"must be a color like #FF88AA"}}},
+		{"hexcolor pointer blank", func(r *request) { r.Border = ptr("   ") }, Errors{"border": {"must be a color like #FF88AA"}}},
+
+		{"ignored", func(r *request) { r.Ignored = "anything" }, Errors{}},
+		{
+			"several problems",
+			func(r *request) { r.Name = ""; r.Role = "admin"; r.Age = 0 },
+			Errors{"name": {"is required"}, "role": {"must be one of owner, member"}, "age": {"must be at least 13"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(&r)
+			if got := Struct(&r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Struct() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type matchingPasswords struct {
+	Password string `json:"password" validate:"required"`
+	Confirm  string `json:"confirm"`
+}
+
+func (r matchingPasswords) Validate(errs Errors) {
+	if r.Password != r.Confirm {
+		errs.Add("confirm", "must match password")
+	}
+}
+
+func TestStructValidator(t *testing.T) {
+	got := Struct(matchingPasswords{Password: "", Confirm: "x"})
+	want := Errors{"password": {"is required"}, "confirm": {"must match password"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Struct() = %v, want %v", got, want)
+	}
+}
+
+func TestStructUnknownRule(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown rule didn't panic")
+		}
+	}()
+	Struct(struct {
+		Name string `validate:"uppercase"`
+	}{Name: "x"})
+}
+
+func TestMerge(t *testing.T) {
+	errs := Errors{"password": {"is required"}}
+	errs.Merge(map[string][]string{"password": {"is too common"}, "username": nil, "email": {}})
+
+	want := Errors{"password": {"is required", "is too common"}}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("after Merge = %v, want %v", errs, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	type request struct {
+		Name  string `json:"name" validate:"required"`
+		Count int    `json:"count"`
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		wantFields Errors
+	}{
+		{"valid", `{"name": "ann", "count": 2}`, 0, "", nil},
+		{"surrounding whitespace", " \n{\"name\": \"ann\"}\n ", 0, "", nil},
+		{"empty body", ``, http.StatusBadRequest, "invalid_json", nil},
+		{"syntax error", `{"name": }`, http.StatusBadRequest, "invalid_json", nil},
+		{"cut off", `{"name": "ann"`, http.StatusBadRequest, "invalid_json", nil},
+		{"unknown field", `{"name": "ann", "admin": true}`, http.StatusBadRequest, "unknown_field", nil},
+		{"trailing object", `{"name": "ann"}{"name": "bob"}`, http.StatusBadRequest, "invalid_json", nil},
+		{"trailing garbage", `{"name": "ann"} x`, http.StatusBadRequest, "invalid_json", nil},
+		{"wrong type", `{"name": "ann", "count": "two"}`, http.StatusUnprocessableEntity, "invalid_fields", Errors{"count": {"must be a whole number"}}},
+		{"fails validation", `{"count": 2}`, http.StatusUnprocessableEntity, "invalid_fields", Errors{"name": {"is required"}}},
+		{"too large", `{"name": "` + strings.Repeat("a", MaxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			var dst request
+			err := Decode(httptest.NewRecorder(), r, &dst)
+
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("Decode() = %v", err)
+				}
+				if dst.Name != "ann" {
+					t.Errorf("decoded name = %q", dst.Name)
+				}
+				return
+			}
+
+			var respErr *response.Error
+			if !errors.As(err, &respErr) {
+				t.Fatalf("Decode() = %v, want a *response.Error", err)
+			}
+			if respErr.Status != tt.wantStatus || respErr.Code != tt.wantCode {
+				t.Errorf("Decode() = %d %s, want %d %s", respErr.Status, respErr.Code, tt.wantStatus, tt.wantCode)
+			}
+			if tt.wantFields != nil && !reflect.DeepEqual(Errors(respErr.Fields), tt.wantFields) {
+				t.Errorf("fields = %v, want %v", respErr.Fields, tt.wantFields)
+			}
+		})
+	}
+}
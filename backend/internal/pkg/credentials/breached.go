@@ -0,0 +1,76 @@
+package credentials
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// SHA-1 hashes of the most common leaked passwords
+//
+//go:embed breached.txt
+var builtinBreached string
+
+// BreachedList answers whether a password shows up in known breaches. it's bucketed by the first 5
+// hex characters of the SHA-1 like the Pwned Passwords range API, so a lookup only ever touches
+// one small bucket and the format works with the published downloads
+type BreachedList struct {
+	ranges map[string]map[string]struct{}
+}
+
+// LoadBreachedList reads the built in list plus the file at path, if given
+func LoadBreachedList(path string) (*BreachedList, error) {
+	list := &BreachedList{ranges: map[string]map[string]struct{}{}}
+	if err := list.read(strings.NewReader(builtinBreached)); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := list.read(f); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	return list, nil
+}
+
+// read accepts one hash per line, optionally followed by :count
+func (l *BreachedList) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); len(hash) != 40 || err != nil {
+			return fmt.Errorf("line %d: not a SHA-1 hash", line)
+		}
+
+		hash = strings.ToUpper(hash)
+		prefix, suffix := hash[:5], hash[5:]
+		if l.ranges[prefix] == nil {
+			l.ranges[prefix] = map[string]struct{}{}
+		}
+		l.ranges[prefix][suffix] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+func (l *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, ok := l.ranges[hash[:5]][hash[5:]]
+	return ok
+}
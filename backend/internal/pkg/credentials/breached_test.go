@@ -0,0 +1,108 @@
+package credentials
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeBreachedFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBreachedList(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contains []string
+		missing  []string
+	}{
+		{
+			name:     "built in only",
+			contains: []string{"password", "password123", "iloveyou"},
+			missing:  []string{"correct horse 7", "Password", ""},
+		},
+		{
+			name:     "extra file",
+			file:     strings.ToUpper(sha1Hex("lovenote rocks")) + "\n",
+			contains: []string{"lovenote rocks", "password"},
+			missing:  []string{"lovenote rocks!"},
+		},
+		{
+			// the Pwned Passwords downloads have a count after each hash and CRLF line endings
+			name:     "pwned passwords format",
+			file:     strings.ToUpper(sha1Hex("first one")) + ":42\r\n" + strings.ToUpper(sha1Hex("second one")) + ":7\r\n",
+			contains: []string{"first one", "second one"},
+		},
+		{
+			name:     "lowercase hashes and blank lines",
+			file:     "\n" + sha1Hex("lowercase") + "\n\n   \n",
+			contains: []string{"lowercase"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeBreachedFile(t, tt.file)
+			}
+			list, err := LoadBreachedList(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, password := range tt.contains {
+				if !list.Contains(password) {
+					t.Errorf("Contains(%q) = false", password)
+				}
+			}
+			for _, password := range tt.missing {
+				if list.Contains(password) {
+					t.Errorf("Contains(%q) = true", password)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBreachedListErrors(t *testing.T) {
+	valid := sha1Hex("valid") + "\n"
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"not a hash", valid + "password\n", "line 2: not a SHA-1 hash"},
+		{"too short", sha1Hex("x")[:39] + "\n", "line 1: not a SHA-1 hash"},
+		{"too long", sha1Hex("x") + "0\n", "line 1: not a SHA-1 hash"},
+		{"not hex", valid + valid + strings.Repeat("Z", 40) + "\n", "line 3: not a SHA-1 hash"},
+		{"hex with a space in it", sha1Hex("x")[:20] + " " + sha1Hex("x")[21:] + "\n", "line 1: not a SHA-1 hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadBreachedList(writeBreachedFile(t, tt.file))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadBreachedList() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadBreachedList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("LoadBreachedList() with a missing file didn't fail")
+	}
+}
@@ -0,0 +1,150 @@
+// Package credentials validates what users sign up and sign in with
+package credentials
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	config "github.com/theEricHoang/lovenote/backend/internal"
+)
+
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 30
+	MaxEmailLength    = 255
+	// bcrypt ignores anything past 72 bytes, so longer passwords would only look stronger
+	MaxBcryptPasswordBytes = 72
+	// argon2id takes any length, this only keeps hashing cheap to ask for
+	MaxPasswordBytes = 1024
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.]*$`)
+
+// FieldErrors maps request fields to everything wrong with them
+type FieldErrors map[string][]string
+
+func (e FieldErrors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+type Validator struct {
+	MinPasswordLength  int
+	MinPasswordClasses int
+	MaxPasswordBytes   int
+	Breached           *BreachedList
+}
+
+func NewValidator(cfg config.Config) (*Validator, error) {
+	breached, err := LoadBreachedList(cfg.BreachedPasswordsFile)
+	if err != nil {
+		return nil, err
+	}
+	maxPasswordBytes := MaxPasswordBytes
+	if cfg.PasswordHashAlgorithm != "argon2id" {
+		maxPasswordBytes = MaxBcryptPasswordBytes
+	}
+	return &Validator{
+		MinPasswordLength:  cfg.PasswordMinLength,
+		MinPasswordClasses: cfg.PasswordMinClasses,
+		MaxPasswordBytes:   maxPasswordBytes,
+		Breached:           breached,
+	}, nil
+}
+
+func (v *Validator) Username(username string) []string {
+	var problems []string
+	length := utf8.RuneCountInString(username)
+	if length < MinUsernameLength || length > MaxUsernameLength {
+		problems = append(problems, fmt.Sprintf("must be between %d and %d characters", MinUsernameLength, MaxUsernameLength))
+	}
+	if username != "" && !usernamePattern.MatchString(username) {
+		problems = append(problems, "may only contain letters, numbers, underscores and periods, and must start with a letter or number")
+	}
+	return problems
+}
+
+func (v *Validator) Email(email string) []string {
+	if email == "" {
+		return []string{"is required"}
+	}
+	if len(email) > MaxEmailLength {
+		return []string{fmt.Sprintf("must be at most %d characters", MaxEmailLength)}
+	}
+
+	// ParseAddress also accepts "Name <address>", only the bare address is allowed here
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return []string{"must be a valid email address"}
+	}
+	return nil
+}
+
+// Password checks a new password. username and email are the account's, a password built from
+// them is the first thing anyone would guess
+func (v *Validator) Password(password, username, email string) []string {
+	var problems []string
+	if utf8.RuneCountInString(password) < v.MinPasswordLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters", v.MinPasswordLength))
+	}
+	if len(password) > v.MaxPasswordBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes", v.MaxPasswordBytes))
+	}
+
+	if classes := characterClasses(password); classes < v.MinPasswordClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, numbers and symbols", v.MinPasswordClasses))
+	}
+
+	lower := strings.ToLower(password)
+	localPart, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if (username != "" && strings.Contains(lower, strings.ToLower(username))) || (len(localPart) >= MinUsernameLength && strings.Contains(lower, localPart)) {
+		problems = append(problems, "must not contain your username or email")
+	}
+
+	if v.Breached.Contains(password) {
+		problems = append(problems, "has appeared in a data breach, choose a different one")
+	}
+	return problems
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	return classes
+}
+
+// Registration validates every field of a new account at once
+func (v *Validator) Registration(username, email, password string) FieldErrors {
+	errs := FieldErrors{}
+	for _, problem := range v.Username(username) {
+		errs.Add("username", problem)
+	}
+	for _, problem := range v.Email(email) {
+		errs.Add("email", problem)
+	}
+	for _, problem := range v.Password(password, username, email) {
+		errs.Add("password", problem)
+	}
+	return errs
+}
@@ -0,0 +1,179 @@
+package credentials
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestValidator(t *testing.T) *Validator {
+	t.Helper()
+	breached, err := LoadBreachedList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Validator{
+		MinPasswordLength:  10,
+		MinPasswordClasses: 2,
+		MaxPasswordBytes:   MaxBcryptPasswordBytes,
+		Breached:           breached,
+	}
+}
+
+func TestPassword(t *testing.T) {
+	v := newTestValidator(t)
+
+	const (
+		tooShort   = "must be at least 10 characters"
+		tooLong    = "must be at most 72 bytes"
+		oneClass   = "must mix at least 2 of lowercase letters, uppercase letters, numbers and symbols"
+		personal   = "must not contain your username or email"
+		inBreaches = "has appeared in a data breach, choose a different one"
+	)
+
+	tests := []struct {
+		name     string
+		password string
+		username string
+		email    string
+		want     []string
+	}{
+		{"valid", "correct horse 7", "jane", "jane@example.com", nil},
+		{"too short", "Ab1!", "jane", "jane@example.com", []string{tooShort}},
+		{"length counts characters", "ääääääääÄÄ", "jane", "jane@example.com", nil},
+		{"too many bytes", strings.Repeat("aB", 37), "jane", "jane@example.com", []string{tooLong}},
+		{"at the byte limit", strings.Repeat("aB", 36), "jane", "jane@example.com", nil},
+		{"lowercase only", "abcdefghijkl", "jane", "jane@example.com", []string{oneClass}},
+		{"digits only", "9081726354", "jane", "jane@example.com", []string{oneClass}},
+		{"short and one class", "abc", "jane", "jane@example.com", []string{tooShort, oneClass}},
+		{"contains the username", "MyNameIsJane1", "jane", "jd@example.com", []string{personal}},
+		{"username in another case", "xJANEx-2024!", "Jane", "jd@example.com", []string{personal}},
+		{"contains the email's local part", "Sweetheart-2024", "jane", "sweetheart@example.com", []string{personal}},
+		{"short local parts are ignored", "Jo-and-me-forever", "jane", "jo@example.com", nil},
+		{"no username yet", "Correct horse", "", "", nil},
+		{"breached", "password123", "jane", "jane@example.com", []string{inBreaches}},
+		{"breached lookups are exact", "PASSWORD123", "jane", "jane@example.com", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v.Password(tt.password, tt.username, tt.email); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Password(%q) = %q, want %q", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordClasses(t *testing.T) {
+	v := newTestValidator(t)
+	v.MinPasswordClasses = 4
+
+	tests := []struct {
+		password string
+		classes  int
+	}{
+		{"abcdefghij", 1},
+		{"abcdeFGHIJ", 2},
+		{"abcdeFGHI1", 3},
+		{"abcdeFGH1!", 4},
+		// anything that isn't a letter or digit is a symbol
+		{"abcdeFGH1 ", 4},
+		{"abcdeFGH1é", 3},
+		{"abcdeFGH1٣", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := characterClasses(tt.password); got != tt.classes {
+				t.Errorf("characterClasses(%q) = %d, want %d", tt.password, got, tt.classes)
+			}
+		})
+	}
+}
+
+func TestUsername(t *testing.T) {
+	v := newTestValidator(t)
+
+	const (
+		length  = "must be between 3 and 30 characters"
+		pattern = "may only contain letters, numbers, underscores and periods, and must start with a letter or number"
+	)
+
+	tests := []struct {
+		name     string
+		username string
+		want     []string
+	}{
+		{"valid", "jane", nil},
+		{"periods and underscores", "jane.doe_99", nil},
+		{"starts with a digit", "99jane", nil},
+		{"shortest", "abc", nil},
+		{"longest", strings.Repeat("a", 30), nil},
+		{"empty", "", []string{length}},
+		{"too short", "jd", []string{length}},
+		{"too long", strings.Repeat("a", 31), []string{length}},
+		{"starts with an underscore", "_jane", []string{pattern}},
+		{"starts with a period", ".jane", []string{pattern}},
+		{"space", "jane doe", []string{pattern}},
+		{"dash", "jane-doe", []string{pattern}},
+		{"non ascii letter", "jäne", []string{pattern}},
+		{"too short and invalid", "j!", []string{length, pattern}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v.Username(tt.username); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Username(%q) = %q, want %q", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmail(t *testing.T) {
+	v := newTestValidator(t)
+
+	const invalid = "must be a valid email address"
+
+	tests := []struct {
+		name  string
+		email string
+		want  []string
+	}{
+		{"valid", "jane@example.com", nil},
+		{"subdomain", "jane.doe@mail.example.co.uk", nil},
+		{"plus", "jane+lovenote@example.com", nil},
+		{"empty", "", []string{"is required"}},
+		{"too long", strings.Repeat("a", 244) + "@example.com", []string{"must be at most 255 characters"}},
+		{"longest", strings.Repeat("a", 243) + "@example.com", nil},
+		{"with a name", "Jane <jane@example.com>", []string{invalid}},
+		{"no at", "jane", []string{invalid}},
+		{"no domain", "jane@", []string{invalid}},
+		{"no dot in the domain", "jane@localhost", []string{invalid}},
+		{"dot only before the at", "jane.doe@localhost", []string{invalid}},
+		{"space", "jane doe@example.com", []string{invalid}},
+		{"surrounding spaces", " jane@example.com ", []string{invalid}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := v.Email(tt.email); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Email(%q) = %q, want %q", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	v := newTestValidator(t)
+
+	if errs := v.Registration("jane", "jane@example.com", "correct horse 7"); len(errs) != 0 {
+		t.Errorf("Registration() = %v, want no errors", errs)
+	}
+
+	errs := v.Registration("j", "jane", "jjjjjjjjjjjj")
+	for _, field := range []string{"username", "email", "password"} {
+		if len(errs[field]) == 0 {
+			t.Errorf("no errors for %s in %v", field, errs)
+		}
+	}
+}
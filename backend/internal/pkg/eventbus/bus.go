@@ -0,0 +1,116 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+// postgres channels events are published on
+const (
+	NoteChannel       = "lovenote_notes"
+	InviteChannel     = "lovenote_invites"
+	MembershipChannel = "lovenote_memberships"
+	RevocationChannel = "lovenote_revocations"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+type Notification struct {
+	Channel string
+	Payload []byte
+}
+
+// Bus fans events out across every backend instance using postgres LISTEN/NOTIFY
+type Bus struct {
+	DB *db.Database
+}
+
+func NewBus(database *db.Database) *Bus {
+	return &Bus{DB: database}
+}
+
+// Publish sends payload as JSON to everyone listening on channel, including this instance.
+// postgres caps a notification at 8000 bytes so payloads should stay small
+func (b *Bus) Publish(ctx context.Context, channel string, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.DB.Pool.Exec(ctx, "SELECT pg_notify($1, $2)", channel, string(raw))
+	return err
+}
+
+// Listen delivers every notification sent on channels until ctx is cancelled, at which point the
+// returned channel is closed. lost connections are re-established automatically, but anything
+// published while disconnected is missed
+func (b *Bus) Listen(ctx context.Context, channels ...string) <-chan Notification {
+	out := make(chan Notification, 64)
+
+	go func() {
+		defer close(out)
+
+		delay := minReconnectDelay
+		for {
+			started := time.Now()
+			err := b.listen(ctx, channels, out)
+			if ctx.Err() != nil {
+				return
+			}
+
+			// only back off further if the connection keeps dying right away
+			if time.Since(started) > maxReconnectDelay {
+				delay = minReconnectDelay
+			}
+			log.Printf("event bus: listener disconnected (%v), reconnecting in %s", err, delay)
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			delay = min(delay*2, maxReconnectDelay)
+		}
+	}()
+
+	return out
+}
+
+func (b *Bus) listen(ctx context.Context, channels []string, out chan<- Notification) error {
+	poolConn, err := b.DB.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// take the connection out of the pool for good so nobody else ends up on a LISTENing session
+	conn := poolConn.Hijack()
+	defer conn.Close(context.Background())
+
+	for _, channel := range channels {
+		_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case out <- Notification{Channel: notification.Channel, Payload: []byte(notification.Payload)}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
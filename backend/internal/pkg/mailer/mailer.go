@@ -0,0 +1,169 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/theEricHoang/lovenote/backend/internal"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional email. pick an implementation with NewMailer
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewMailer returns the SMTP mailer when MAILER=smtp, otherwise one that only logs messages for local development
+func NewMailer(cfg config.Config) Mailer {
+	if cfg.Mailer == "smtp" {
+		return NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	}
+	return NewLogMailer(cfg.MailLogFile)
+}
+
+// SMTPTimeout bounds a whole delivery, on top of whatever deadline the caller's context has
+const SMTPTimeout = 30 * time.Second
+
+type SMTPMailer struct {
+	Host string
+	Addr string
+	Auth smtp.Auth
+	// the From header, which can include a display name like "lovenote <no-reply@lovenote.app>"
+	From string
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{Host: host, Addr: net.JoinHostPort(host, fmt.Sprint(port)), Auth: auth, From: from}
+}
+
+// Send delivers msg the way smtp.SendMail does, but gives up when ctx is done
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	// the envelope only takes the bare address, the display name is for the header
+	sender, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", m.From, err)
+	}
+	recipient, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, SMTPTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the deadline covers every read and write, and closing the connection unblocks them early if ctx is cancelled
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// upgrade to TLS through STARTTLS whenever the server supports it, like smtp.SendMail
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+			return err
+		}
+	}
+	if m.Auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server doesn't support AUTH")
+		}
+		if err = client.Auth(m.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(format(m.From, msg)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// LogMailer writes messages to a file, or the server log when no path is set, instead of sending them
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{Path: path}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	raw := format("lovenote@localhost", msg)
+	if m.Path == "" {
+		log.Printf("mail to %s:\n%s", msg.To, raw)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\n\n", raw)
+	return err
+}
+
+func format(from string, msg Message) []byte {
+	// keep header injection out of anything user controlled
+	clean := strings.NewReplacer("\r", "", "\n", "").Replace
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
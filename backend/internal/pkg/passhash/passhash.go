@@ -0,0 +1,151 @@
+// Package passhash hashes passwords with bcrypt or argon2id and tells when a stored hash falls
+// short of the configured policy. argon2id hashes are stored in the PHC string format, bcrypt
+// hashes in their usual $2a$ form
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+
+	saltLength = 16
+	keyLength  = 32
+)
+
+var (
+	ErrMismatch         = errors.New("password doesn't match hash")
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrMalformedHash    = errors.New("malformed password hash")
+)
+
+var encoding = base64.RawStdEncoding
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB
+type Argon2Params struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// Hasher hashes new passwords with Algorithm and verifies hashes made with either algorithm
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+func NewHasher(algorithm string, bcryptCost int, argon2Params Argon2Params) (*Hasher, error) {
+	switch algorithm {
+	case Bcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+		if argon2Params.Memory < 8*uint32(argon2Params.Threads) || argon2Params.Time < 1 || argon2Params.Threads < 1 {
+			return nil, errors.New("argon2id needs a time and threads of at least 1 and at least 8 KiB of memory per thread")
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm)
+	}
+	return &Hasher{Algorithm: algorithm, BcryptCost: bcryptCost, Argon2: argon2Params}, nil
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Argon2.Time, h.Argon2.Memory, h.Argon2.Threads, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Argon2.Memory, h.Argon2.Time, h.Argon2.Threads,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// Verify checks password against a hash made with any supported algorithm and parameters
+func (h *Hasher) Verify(hash, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrMismatch
+	}
+	return err
+}
+
+// NeedsRehash reports whether hash was made with another algorithm or weaker parameters than
+// the hasher would use now
+func (h *Hasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if h.Algorithm != Argon2id {
+			return true
+		}
+		params, _, key, err := parseArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		return params.Memory < h.Argon2.Memory || params.Time < h.Argon2.Time ||
+			params.Threads < h.Argon2.Threads || len(key) < keyLength
+	}
+
+	if h.Algorithm != Bcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.BcryptCost
+}
+
+// parseArgon2id splits $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func parseArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := encoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	key, err := encoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	return params, salt, key, nil
+}
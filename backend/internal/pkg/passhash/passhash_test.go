@@ -0,0 +1,170 @@
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheap parameters so the tests stay fast
+var testArgon2 = Argon2Params{Memory: 64, Time: 1, Threads: 1}
+
+func mustHasher(t *testing.T, algorithm string, cost int, params Argon2Params) *Hasher {
+	t.Helper()
+	h, err := NewHasher(algorithm, cost, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func mustHash(t *testing.T, h *Hasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestNewHasher(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		cost      int
+		params    Argon2Params
+		wantErr   bool
+	}{
+		{"bcrypt", Bcrypt, bcrypt.MinCost, Argon2Params{}, false},
+		{"bcrypt cost too low", Bcrypt, bcrypt.MinCost - 1, Argon2Params{}, true},
+		{"bcrypt cost too high", Bcrypt, bcrypt.MaxCost + 1, Argon2Params{}, true},
+		{"argon2id", Argon2id, 0, testArgon2, false},
+		{"argon2id no time", Argon2id, 0, Argon2Params{Memory: 64, Time: 0, Threads: 1}, true},
+		{"argon2id no threads", Argon2id, 0, Argon2Params{Memory: 64, Time: 1, Threads: 0}, true},
+		{"argon2id too little memory", Argon2id, 0, Argon2Params{Memory: 15, Time: 1, Threads: 2}, true},
+		{"unknown", "md5", 0, Argon2Params{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHasher(tt.algorithm, tt.cost, tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHasher() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashVerify(t *testing.T) {
+	hashers := []struct {
+		name   string
+		hasher *Hasher
+		prefix string
+	}{
+		{"bcrypt", mustHasher(t, Bcrypt, bcrypt.MinCost, testArgon2), "$2a$"},
+		{"argon2id", mustHasher(t, Argon2id, bcrypt.MinCost, testArgon2), "$argon2id$v=19$m=64,t=1,p=1$"},
+	}
+	passwords := []string{"correct horse battery staple", "ünïcödé pässwörd", " "}
+
+	for _, hh := range hashers {
+		for _, password := range passwords {
+			t.Run(hh.name+"/"+password, func(t *testing.T) {
+				hash := mustHash(t, hh.hasher, password)
+				if !strings.HasPrefix(hash, hh.prefix) {
+					t.Errorf("hash %q doesn't start with %q", hash, hh.prefix)
+				}
+				if err := hh.hasher.Verify(hash, password); err != nil {
+					t.Errorf("Verify with the right password: %v", err)
+				}
+				if err := hh.hasher.Verify(hash, password+"x"); !errors.Is(err, ErrMismatch) {
+					t.Errorf("Verify with the wrong password = %v, want ErrMismatch", err)
+				}
+				if again := mustHash(t, hh.hasher, password); again == hash {
+					t.Error("hashing the same password twice gave the same hash, the salt isn't random")
+				}
+			})
+		}
+	}
+}
+
+// hashes made before switching algorithms have to keep working
+func TestVerifyOtherAlgorithm(t *testing.T) {
+	bcryptHasher := mustHasher(t, Bcrypt, bcrypt.MinCost, testArgon2)
+	argonHasher := mustHasher(t, Argon2id, bcrypt.MinCost, testArgon2)
+
+	if err := argonHasher.Verify(mustHash(t, bcryptHasher, "password"), "password"); err != nil {
+		t.Errorf("argon2id hasher verifying a bcrypt hash: %v", err)
+	}
+	if err := bcryptHasher.Verify(mustHash(t, argonHasher, "password"), "password"); err != nil {
+		t.Errorf("bcrypt hasher verifying an argon2id hash: %v", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	h := mustHasher(t, Argon2id, bcrypt.MinCost, testArgon2)
+	valid := mustHash(t, h, "password")
+	parts := strings.Split(valid, "$")
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"missing key", strings.Join(parts[:5], "$")},
+		{"wrong version", strings.Replace(valid, "v=19", "v=16", 1)},
+		{"bad params", strings.Replace(valid, "m=64,t=1,p=1", "m=64,t=one,p=1", 1)},
+		{"zero time", strings.Replace(valid, "t=1", "t=0", 1)},
+		{"zero threads", strings.Replace(valid, "p=1", "p=0", 1)},
+		{"bad salt", strings.Join(append(parts[:4:4], "!!!", parts[5]), "$")},
+		{"empty key", strings.Join(append(parts[:5:5], ""), "$")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := h.Verify(tt.hash, "password"); !errors.Is(err, ErrMalformedHash) {
+				t.Errorf("Verify(%q) = %v, want ErrMalformedHash", tt.hash, err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt4 := mustHasher(t, Bcrypt, 4, testArgon2)
+	bcrypt5 := mustHasher(t, Bcrypt, 5, testArgon2)
+	argon := mustHasher(t, Argon2id, 4, testArgon2)
+	argonMoreMemory := mustHasher(t, Argon2id, 4, Argon2Params{Memory: 128, Time: 1, Threads: 1})
+	argonMoreTime := mustHasher(t, Argon2id, 4, Argon2Params{Memory: 64, Time: 2, Threads: 1})
+	argonMoreThreads := mustHasher(t, Argon2id, 4, Argon2Params{Memory: 64, Time: 1, Threads: 2})
+
+	bcryptHash := mustHash(t, bcrypt4, "password")
+	argonHash := mustHash(t, argon, "password")
+
+	tests := []struct {
+		name   string
+		hasher *Hasher
+		hash   string
+		want   bool
+	}{
+		{"bcrypt at the same cost", bcrypt4, bcryptHash, false},
+		{"bcrypt at a lower cost", bcrypt5, bcryptHash, true},
+		{"bcrypt at a higher cost", bcrypt4, mustHash(t, bcrypt5, "password"), false},
+		{"bcrypt hash under argon2id", argon, bcryptHash, true},
+		{"argon2id with the same params", argon, argonHash, false},
+		{"argon2id with less memory", argonMoreMemory, argonHash, true},
+		{"argon2id with less time", argonMoreTime, argonHash, true},
+		{"argon2id with fewer threads", argonMoreThreads, argonHash, true},
+		{"argon2id with more than needed", argon, mustHash(t, argonMoreMemory, "password"), false},
+		{"argon2id hash under bcrypt", bcrypt4, argonHash, true},
+		{"malformed argon2id", argon, "$argon2id$garbage", true},
+		{"malformed bcrypt", bcrypt4, "garbage", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestStore() (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := NewMemoryStore()
+	s.now = clock.Now
+	s.lastSweep = clock.now
+	return s, clock
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	// one token a second
+	policy := Policy{Name: "test", Limit: 3, Period: 3 * time.Second}
+
+	type take struct {
+		advance    time.Duration
+		key        string
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{
+			name: "burst up to the limit",
+			takes: []take{
+				{0, "a", true, 2, 0, time.Second},
+				{0, "a", true, 1, 0, 2 * time.Second},
+				{0, "a", true, 0, 0, 3 * time.Second},
+				{0, "a", false, 0, time.Second, 3 * time.Second},
+			},
+		},
+		{
+			name: "refills over time",
+			takes: []take{
+				{0, "a", true, 2, 0, time.Second},
+				{0, "a", true, 1, 0, 2 * time.Second},
+				{0, "a", true, 0, 0, 3 * time.Second},
+				{500 * time.Millisecond, "a", false, 0, 500 * time.Millisecond, 2500 * time.Millisecond},
+				{500 * time.Millisecond, "a", true, 0, 0, 3 * time.Second},
+				{2 * time.Second, "a", true, 1, 0, 2 * time.Second},
+			},
+		},
+		{
+			name: "never refills past the limit",
+			takes: []take{
+				{0, "a", true, 2, 0, time.Second},
+				{time.Hour, "a", true, 2, 0, time.Second},
+			},
+		},
+		{
+			name: "keys are separate",
+			takes: []take{
+				{0, "a", true, 2, 0, time.Second},
+				{0, "a", true, 1, 0, 2 * time.Second},
+				{0, "a", true, 0, 0, 3 * time.Second},
+				{0, "a", false, 0, time.Second, 3 * time.Second},
+				{0, "b", true, 2, 0, time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, clock := newTestStore()
+			for i, take := range tt.takes {
+				clock.Advance(take.advance)
+				d, err := s.Take(context.Background(), take.key, policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := Decision{
+					Allowed:    take.allowed,
+					Limit:      policy.Limit,
+					Remaining:  take.remaining,
+					RetryAfter: take.retryAfter,
+					Reset:      take.reset,
+				}
+				if d != want {
+					t.Errorf("take %d = %+v, want %+v", i, d, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s, clock := newTestStore()
+	short := Policy{Name: "short", Limit: 1, Period: time.Second}
+	long := Policy{Name: "long", Limit: 1, Period: time.Hour}
+
+	take := func(key string, policy Policy) Decision {
+		d, err := s.Take(context.Background(), key, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	take("short", short)
+	take("long", long)
+
+	// sweeps run at most once a minute
+	clock.Advance(30 * time.Second)
+	take("other", short)
+	if len(s.buckets) != 3 {
+		t.Fatalf("%d buckets before the first sweep, want 3", len(s.buckets))
+	}
+
+	clock.Advance(31 * time.Second)
+	take("other", short)
+	if _, ok := s.buckets["short"]; ok {
+		t.Error("refilled bucket wasn't swept")
+	}
+	if _, ok := s.buckets["long"]; !ok {
+		t.Error("bucket still refilling was swept")
+	}
+
+	// the long bucket is still empty after the sweep ran
+	if d := take("long", long); d.Allowed {
+		t.Error("take on an empty bucket was allowed after a sweep")
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+// PostgresStore keeps buckets in postgres so limits hold across every instance. refills are
+// computed from the database clock, so instances with drifting clocks still agree
+type PostgresStore struct {
+	DB *db.Database
+}
+
+func NewPostgresStore(database *db.Database) *PostgresStore {
+	return &PostgresStore{DB: database}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, policy Policy) (Decision, error) {
+	// every SET expression sees the old row, so the refilled amount is computed the same way in each
+	query := `
+		INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::float8 - 1, TRUE, CURRENT_TIMESTAMP)
+		ON CONFLICT (key) DO UPDATE SET
+			allowed = LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - b.updated_at) * $3::float8) >= 1,
+			tokens = LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - b.updated_at) * $3::float8)
+				- CASE WHEN LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - b.updated_at) * $3::float8) >= 1 THEN 1 ELSE 0 END,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING tokens, allowed
+	`
+	var tokens float64
+	var allowed bool
+	err := s.DB.Pool.QueryRow(ctx, query, key, float64(policy.Limit), policy.rate()).Scan(&tokens, &allowed)
+	if err != nil {
+		return Decision{}, err
+	}
+	return decide(policy, tokens, allowed), nil
+}
+
+// Prune deletes buckets untouched for longer than maxAge every interval until ctx is cancelled.
+// maxAge has to be at least the longest policy period, by then those buckets are full anyway
+func (s *PostgresStore) Prune(ctx context.Context, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			query := "DELETE FROM rate_limit_buckets WHERE updated_at < CURRENT_TIMESTAMP - make_interval(secs => $1)"
+			_, err := s.DB.Pool.Exec(ctx, query, maxAge.Seconds())
+			if err != nil && ctx.Err() == nil {
+				log.Printf("error pruning rate limit buckets: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
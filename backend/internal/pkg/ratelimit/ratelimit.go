@@ -0,0 +1,50 @@
+// Package ratelimit implements token bucket rate limiting with pluggable storage
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Policy allows bursts of up to Limit requests, refilling the whole bucket over Period
+type Policy struct {
+	// Name keeps buckets of different policies apart, e.g. "search"
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// refill rate in tokens per second
+func (p Policy) rate() float64 {
+	return float64(p.Limit) / p.Period.Seconds()
+}
+
+type Decision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// how long until another request is allowed, zero when this one was
+	RetryAfter time.Duration
+	// how long until the bucket is full again
+	Reset time.Duration
+}
+
+func decide(policy Policy, tokens float64, allowed bool) Decision {
+	rate := policy.rate()
+	decision := Decision{
+		Allowed:   allowed,
+		Limit:     policy.Limit,
+		Remaining: max(0, int(math.Floor(tokens))),
+		Reset:     time.Duration((float64(policy.Limit) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		decision.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return decision
+}
+
+// Store keeps the buckets. Take removes a token from the bucket for key if there is one
+type Store interface {
+	Take(ctx context.Context, key string, policy Policy) (Decision, error)
+}
@@ -0,0 +1,81 @@
+package realtime
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/db"
+)
+
+// EventLog persists published events so clients that were disconnected can catch up on what they missed
+type EventLog struct {
+	DB *db.Database
+}
+
+func NewEventLog(database *db.Database) *EventLog {
+	return &EventLog{DB: database}
+}
+
+// Append stores event and returns it with its assigned id
+func (l *EventLog) Append(ctx context.Context, event Event) (Event, error) {
+	query := `
+		INSERT INTO relationship_events (relationship_id, type, data)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`
+	err := l.DB.Pool.QueryRow(ctx, query, event.RelationshipID, event.Type, event.Data).Scan(&event.Id)
+	if err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+// Since returns up to limit events for the relationship with ids above afterID, oldest first. ids
+// are handed out on insert, so an event numbered lower than the ones returned may still be committed later
+func (l *EventLog) Since(ctx context.Context, relationshipID uint, afterID int64, limit int) ([]Event, error) {
+	query := `
+		SELECT id, relationship_id, type, data
+		FROM relationship_events
+		WHERE relationship_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+
+	rows, err := l.DB.Pool.Query(ctx, query, relationshipID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.Id, &event.RelationshipID, &event.Type, &event.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// Prune deletes every event older than retention, once per interval until ctx is cancelled
+func (l *EventLog) Prune(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		query := "DELETE FROM relationship_events WHERE created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)"
+		_, err := l.DB.Pool.Exec(ctx, query, retention.Seconds())
+		if err != nil && ctx.Err() == nil {
+			log.Printf("error pruning event log: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
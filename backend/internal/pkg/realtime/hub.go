@@ -0,0 +1,100 @@
+package realtime
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+const (
+	NoteCreated = "note.created"
+	NoteEdited  = "note.edited"
+	NoteMoved   = "note.moved"
+	NoteDeleted = "note.deleted"
+)
+
+// how many events a subscriber can fall behind before it gets dropped
+const subscriberBuffer = 32
+
+type Event struct {
+	Id             int64           `json:"id,omitempty"`
+	Type           string          `json:"type"`
+	RelationshipID uint            `json:"relationship_id"`
+	Data           json.RawMessage `json:"data"`
+}
+
+func NewEvent(eventType string, relationshipID uint, data any) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: eventType, RelationshipID: relationshipID, Data: raw}, nil
+}
+
+type Subscriber struct {
+	RelationshipID uint
+	Events         chan Event
+}
+
+// Hub fans events out to every subscriber of a relationship within this process
+type Hub struct {
+	mu    sync.RWMutex
+	rooms map[uint]map[*Subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{rooms: map[uint]map[*Subscriber]struct{}{}}
+}
+
+func (h *Hub) Subscribe(relationshipID uint) *Subscriber {
+	sub := &Subscriber{RelationshipID: relationshipID, Events: make(chan Event, subscriberBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[relationshipID]
+	if !ok {
+		room = map[*Subscriber]struct{}{}
+		h.rooms[relationshipID] = room
+	}
+	room[sub] = struct{}{}
+
+	return sub
+}
+
+// Unsubscribe removes sub and closes its channel. safe to call more than once
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// remove expects h.mu to be held for writing
+func (h *Hub) remove(sub *Subscriber) {
+	room, ok := h.rooms[sub.RelationshipID]
+	if !ok {
+		return
+	}
+	if _, ok := room[sub]; !ok {
+		return
+	}
+
+	delete(room, sub)
+	close(sub.Events)
+	if len(room) == 0 {
+		delete(h.rooms, sub.RelationshipID)
+	}
+}
+
+// Publish never blocks; subscribers too slow to keep up are disconnected instead
+func (h *Hub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.rooms[event.RelationshipID] {
+		select {
+		case sub.Events <- event:
+		default:
+			h.remove(sub)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/theEricHoang/lovenote/backend/internal/pkg/eventbus"
+)
+
+const (
+	InviteCreated = "invite.created"
+	// sent when a pending invite is accepted, declined or cancelled, with its new status
+	InviteClosed  = "invite.closed"
+	MemberJoined  = "member.joined"
+	MemberLeft    = "member.left"
+	MemberRemoved = "member.removed"
+	// also sent for whoever becomes owner when the owner leaves
+	MemberRoleChanged = "member.role_changed"
+)
+
+// which bus channel each event type travels on
+var channels = map[string]string{
+	NoteCreated:       eventbus.NoteChannel,
+	NoteEdited:        eventbus.NoteChannel,
+	NoteMoved:         eventbus.NoteChannel,
+	NoteDeleted:       eventbus.NoteChannel,
+	InviteCreated:     eventbus.InviteChannel,
+	InviteClosed:      eventbus.InviteChannel,
+	MemberJoined:      eventbus.MembershipChannel,
+	MemberLeft:        eventbus.MembershipChannel,
+	MemberRemoved:     eventbus.MembershipChannel,
+	MemberRoleChanged: eventbus.MembershipChannel,
+}
+
+// Publisher is what handlers use to announce changes to a relationship. events are written to the
+// log for clients that need to catch up, then go through the bus so clients on any instance receive them
+type Publisher struct {
+	Bus *eventbus.Bus
+	Log *EventLog
+}
+
+func NewPublisher(bus *eventbus.Bus, eventLog *EventLog) *Publisher {
+	return &Publisher{Bus: bus, Log: eventLog}
+}
+
+// Publish is best effort: the change it describes has already happened, so failures are only logged
+func (p *Publisher) Publish(ctx context.Context, eventType string, relationshipID uint, data any) {
+	event, err := NewEvent(eventType, relationshipID, data)
+	if err != nil {
+		log.Printf("error encoding %s event: %v", eventType, err)
+		return
+	}
+
+	channel, ok := channels[eventType]
+	if !ok {
+		log.Printf("no channel registered for %s events", eventType)
+		return
+	}
+
+	// live clients can still be told about it without an id, they just can't resume from it
+	logged, err := p.Log.Append(ctx, event)
+	if err != nil {
+		log.Printf("error logging %s event: %v", eventType, err)
+	} else {
+		event = logged
+	}
+
+	err = p.Bus.Publish(ctx, channel, event)
+	if err != nil {
+		log.Printf("error publishing %s event: %v", eventType, err)
+	}
+}
+
+// Relay feeds events arriving on the bus into the hub until ctx is cancelled
+func (h *Hub) Relay(ctx context.Context, bus *eventbus.Bus) {
+	notifications := bus.Listen(ctx, eventbus.NoteChannel, eventbus.InviteChannel, eventbus.MembershipChannel)
+	for notification := range notifications {
+		var event Event
+		err := json.Unmarshal(notification.Payload, &event)
+		if err != nil {
+			log.Printf("error decoding event from %s: %v", notification.Channel, err)
+			continue
+		}
+		h.Publish(event)
+	}
+}
@@ -0,0 +1,120 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// base32 of the ASCII secret "12345678901234567890" used by the RFC 6238 appendix B vectors
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B, SHA1. the RFC lists 8 digit codes, these are their last 6 digits
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", rfcSecret, codeAt(step), step, true},
+		{"previous step", rfcSecret, codeAt(step - 1), step - 1, true},
+		{"next step", rfcSecret, codeAt(step + 1), step + 1, true},
+		{"two steps old", rfcSecret, codeAt(step - 2), 0, false},
+		{"two steps ahead", rfcSecret, codeAt(step + 2), 0, false},
+		{"spaces in code", rfcSecret, codeAt(step)[:3] + " " + codeAt(step)[3:], step, true},
+		{"lowercase secret", strings.ToLower(rfcSecret), codeAt(step), step, true},
+		{"too short", rfcSecret, codeAt(step)[:5], 0, false},
+		{"too long", rfcSecret, codeAt(step) + "0", 0, false},
+		{"wrong code", rfcSecret, "000000", 0, false},
+		{"invalid secret", "not base32!", codeAt(step), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := Validate(tt.secret, tt.code, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q isn't unpadded base32: %v", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret is %d bytes, want 20", len(key))
+	}
+
+	other, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == secret {
+		t.Error("two secrets came out the same")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("lovenote", "someone@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("got %s://%s, want otpauth://totp", uri.Scheme, uri.Host)
+	}
+	if uri.Path != "/lovenote:someone@example.com" {
+		t.Errorf("label = %q", uri.Path)
+	}
+
+	want := map[string]string{"secret": rfcSecret, "issuer": "lovenote", "algorithm": "SHA1", "digits": "6", "period": "30"}
+	for key, value := range want {
+		if got := uri.Query().Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+drop table invites;
+drop table notes;
+drop table relationship_members;
+drop table relationships;
+drop table users;
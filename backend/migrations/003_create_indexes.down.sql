@@ -0,0 +1,8 @@
+DROP INDEX idx_invites_relationship_id;
+DROP INDEX idx_invites_inviter_id;
+DROP INDEX idx_invites_invitee_id;
+
+DROP INDEX idx_relationship_members_relationship_id;
+DROP INDEX idx_relationship_members_user_id;
+
+DROP INDEX idx_notes_author_id;
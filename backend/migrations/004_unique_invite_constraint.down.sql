@@ -0,0 +1 @@
+ALTER TABLE invites DROP CONSTRAINT unique_invite;
@@ -0,0 +1 @@
+DROP TABLE relationship_events;
@@ -0,0 +1,10 @@
+CREATE TABLE relationship_events (
+    id BIGSERIAL PRIMARY KEY,
+    relationship_id INT NOT NULL REFERENCES relationships(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_relationship_events_relationship_id ON relationship_events(relationship_id, id);
+CREATE INDEX idx_relationship_events_created_at ON relationship_events(created_at);
@@ -0,0 +1,14 @@
+DROP TABLE security_events;
+
+ALTER TABLE sessions ADD COLUMN token_hash TEXT NULL;
+
+UPDATE sessions s
+SET token_hash = rt.token_hash
+FROM refresh_tokens rt
+WHERE rt.session_id = s.id AND rt.rotated_at IS NULL;
+
+DELETE FROM sessions WHERE token_hash IS NULL;
+
+ALTER TABLE sessions ALTER COLUMN token_hash SET NOT NULL, ADD CONSTRAINT sessions_token_hash_key UNIQUE (token_hash);
+
+DROP TABLE refresh_tokens;
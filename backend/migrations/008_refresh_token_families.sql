@@ -0,0 +1,30 @@
+CREATE TABLE refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    parent_id BIGINT NULL REFERENCES refresh_tokens(id) ON DELETE SET NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    rotated_at TIMESTAMPTZ NULL
+);
+
+CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+
+-- carry every existing session's current token over as the root of its family
+INSERT INTO refresh_tokens (session_id, token_hash, expires_at)
+SELECT id, token_hash, expires_at FROM sessions;
+
+ALTER TABLE sessions DROP COLUMN token_hash;
+
+CREATE TABLE security_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL,
+    session_id UUID NULL,
+    ip_address TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_security_events_user_id ON security_events(user_id);
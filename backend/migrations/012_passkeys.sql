@@ -0,0 +1,25 @@
+-- the random user handle authenticators store with a passkey, set the first time a user registers one
+ALTER TABLE users ADD COLUMN webauthn_handle BYTEA NULL UNIQUE;
+
+CREATE TABLE webauthn_credentials (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    credential JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMPTZ NULL
+);
+
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+-- challenges handed out by a begin endpoint, waiting for the matching finish call
+CREATE TABLE webauthn_ceremonies (
+    id UUID PRIMARY KEY,
+    user_id INT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    session JSONB NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_webauthn_ceremonies_expires_at ON webauthn_ceremonies(expires_at);
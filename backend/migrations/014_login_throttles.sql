@@ -0,0 +1,9 @@
+-- recent failed logins, keyed by 'account:<username>' or 'ip:<address>'
+CREATE TABLE login_throttles (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ NULL
+);
+
+CREATE INDEX idx_login_throttles_last_failure_at ON login_throttles(last_failure_at);
@@ -0,0 +1,2 @@
+-- fails while any argon2id hashes are left, switch back to bcrypt and let everyone log in first
+ALTER TABLE users ALTER COLUMN password_hash TYPE VARCHAR(60);
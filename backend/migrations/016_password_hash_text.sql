@@ -0,0 +1,2 @@
+-- argon2id hashes are stored as PHC strings, which don't fit bcrypt's 60 characters
+ALTER TABLE users ALTER COLUMN password_hash TYPE TEXT;
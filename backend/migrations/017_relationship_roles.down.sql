@@ -0,0 +1,3 @@
+DROP INDEX idx_relationship_members_owner;
+
+ALTER TABLE relationship_members DROP COLUMN role;
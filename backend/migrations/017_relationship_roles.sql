@@ -0,0 +1,16 @@
+ALTER TABLE relationship_members
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'member'
+    CHECK (role IN ('owner', 'admin', 'member', 'viewer'));
+
+-- nobody was tracked as the creator, so the earliest account in each relationship takes it over
+UPDATE relationship_members rm
+SET role = 'owner'
+FROM (
+    SELECT relationship_id, MIN(user_id) AS user_id
+    FROM relationship_members
+    GROUP BY relationship_id
+) first_members
+WHERE rm.relationship_id = first_members.relationship_id
+AND rm.user_id = first_members.user_id;
+
+CREATE UNIQUE INDEX idx_relationship_members_owner ON relationship_members(relationship_id) WHERE role = 'owner';
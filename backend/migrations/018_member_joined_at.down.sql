@@ -0,0 +1 @@
+ALTER TABLE relationship_members DROP COLUMN joined_at;
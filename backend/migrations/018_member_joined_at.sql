@@ -0,0 +1,2 @@
+-- when ownership has to pass on, it goes to whoever has been around longest
+ALTER TABLE relationship_members ADD COLUMN joined_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
@@ -0,0 +1 @@
+ALTER TABLE relationships DROP COLUMN type;
@@ -0,0 +1,4 @@
+-- existing relationships become groups, whose limits match the old fixed ones: no member cap and 10 per user
+ALTER TABLE relationships
+    ADD COLUMN type TEXT NOT NULL DEFAULT 'group'
+    CHECK (type IN ('couple', 'friends', 'family', 'group'));
@@ -0,0 +1 @@
+DROP TABLE invite_links;
@@ -0,0 +1,17 @@
+-- invites anyone holding the link can redeem, including people who don't have an account yet
+CREATE TABLE invite_links (
+    id SERIAL PRIMARY KEY,
+    relationship_id INT NOT NULL REFERENCES relationships(id) ON DELETE CASCADE,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    -- when set, only an account that verified this email can redeem the link
+    email TEXT,
+    -- NULL means the link can be used any number of times until it expires
+    max_uses INT CHECK (max_uses > 0),
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_invite_links_relationship_id ON invite_links(relationship_id);
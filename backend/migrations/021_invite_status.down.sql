@@ -0,0 +1,12 @@
+DROP INDEX idx_invites_pending_expires_at;
+DROP INDEX idx_invites_pending;
+
+-- the old table only ever held pending invites
+DELETE FROM invites WHERE status <> 'pending';
+ALTER TABLE invites ADD CONSTRAINT unique_invite UNIQUE (relationship_id, invitee_id);
+
+ALTER TABLE invites
+    DROP COLUMN responded_at,
+    DROP COLUMN expires_at,
+    DROP COLUMN created_at,
+    DROP COLUMN status;
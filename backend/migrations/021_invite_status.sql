@@ -0,0 +1,16 @@
+ALTER TABLE invites
+    ADD COLUMN status TEXT NOT NULL DEFAULT 'pending'
+        CHECK (status IN ('pending', 'accepted', 'declined', 'cancelled', 'expired')),
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- invites sent before this had no expiry, they get the default from now on
+    ADD COLUMN expires_at TIMESTAMPTZ NOT NULL DEFAULT NOW() + INTERVAL '14 days',
+    -- when the invite stopped being pending
+    ADD COLUMN responded_at TIMESTAMPTZ;
+
+ALTER TABLE invites ALTER COLUMN expires_at DROP DEFAULT;
+
+-- answered invites are kept, so only a pending one has to be unique
+ALTER TABLE invites DROP CONSTRAINT unique_invite;
+CREATE UNIQUE INDEX idx_invites_pending ON invites(relationship_id, invitee_id) WHERE status = 'pending';
+
+CREATE INDEX idx_invites_pending_expires_at ON invites(expires_at) WHERE status = 'pending';